@@ -3,29 +3,297 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log/slog"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/ferranbt/sparkanywhere/sparkanywhere"
 )
 
+// confFlag is a repeated 'key=value' flag
+type confFlag map[string]string
+
+func (c confFlag) String() string {
+	return fmt.Sprint(map[string]string(c))
+}
+
+func (c confFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("expected key=value but found '%s'", value)
+	}
+	c[key] = val
+	return nil
+}
+
+// optionalBoolFlag is a bool flag that leaves the value nil unless it is set,
+// so that the library default applies
+type optionalBoolFlag struct {
+	value **bool
+}
+
+func (b optionalBoolFlag) String() string {
+	if b.value == nil || *b.value == nil {
+		return ""
+	}
+	return strconv.FormatBool(**b.value)
+}
+
+func (b optionalBoolFlag) Set(value string) error {
+	v, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	*b.value = &v
+	return nil
+}
+
+func (b optionalBoolFlag) IsBoolFlag() bool {
+	return true
+}
+
+// envName returns the environment variable of a flag (i.e. ecs-cluster-name
+// is SPARKANYWHERE_ECS_CLUSTER_NAME)
+func envName(flagName string) string {
+	return "SPARKANYWHERE_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// setupLogger installs the default slog logger with the format and level
+func setupLogger(format, level string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level '%s': %w", level, err)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid log format '%s', expected text or json", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
 func main() {
 	cfg := &sparkanywhere.Config{
-		EcsConfig: &sparkanywhere.ECSConfig{},
+		EcsConfig:        &sparkanywhere.ECSConfig{},
+		DockerConfig:     &sparkanywhere.DockerConfig{},
+		KubernetesConfig: &sparkanywhere.KubernetesConfig{},
+		NomadConfig:      &sparkanywhere.NomadConfig{},
+		SparkConf:        map[string]string{},
+		GlobalEnv:        map[string]string{},
 	}
 
+	var (
+		benchmark  int
+		configFile string
+		dnsServers string
+		jobsFile   string
+		logFormat  string
+		logLevel   string
+		namespaces string
+		pyFiles    string
+
+		nomadDatacenters string
+	)
+
+	flag.StringVar(&configFile, "config", "", "Path to a YAML or JSON config file, the flags override its values")
 	flag.BoolVar(&cfg.EcsEnabled, "ecs", false, "Use ECS as the provider")
 	flag.BoolVar(&cfg.DockerEnabled, "docker", false, "Use Docker as the provider")
+	flag.BoolVar(&cfg.KubernetesEnabled, "kubernetes", false, "Use an existing Kubernetes cluster as the provider")
+	flag.BoolVar(&cfg.NomadEnabled, "nomad", false, "Use Nomad as the provider")
+	flag.BoolVar(&cfg.LocalEnabled, "local", false, "Run the tasks as local processes (for testing)")
+	flag.StringVar(&cfg.DefaultProvider, "default-provider", "", "Provider for the driver and the pods without provider annotation (required with more than one provider)")
 	flag.StringVar(&cfg.EcsConfig.ClusterName, "ecs-cluster-name", "", "")
+	flag.StringVar(&cfg.EcsConfig.Region, "ecs-region", "", "AWS region of the ECS cluster (default: AWS_REGION)")
 	flag.StringVar(&cfg.EcsConfig.SecurityGroup, "ecs-security-group", "", "")
-	flag.StringVar(&cfg.EcsConfig.SubnetId, "ecs-subnet-id", "", "")
+	flag.StringVar(&cfg.EcsConfig.SubnetId, "ecs-subnet-id", "", "Comma separated list of subnets to place the ECS tasks")
+	flag.StringVar(&cfg.EcsConfig.RoleArn, "ecs-role-arn", "", "IAM role to assume to run the ECS tasks")
+	flag.Var(optionalBoolFlag{&cfg.EcsConfig.AssignPublicIp}, "ecs-assign-public-ip", "Assign a public ip to the ECS tasks (default: true)")
+	flag.StringVar(&cfg.EcsConfig.TaskDefinitionFamily, "ecs-task-definition-family", "", "ECS task definition family to run the tasks (default: auto-discover)")
+	flag.IntVar(&cfg.EcsConfig.TaskDefinitionRevision, "ecs-task-definition-revision", 0, "ECS task definition revision to run the tasks (default: latest)")
+	flag.StringVar(&cfg.EcsConfig.CapacityProvider, "ecs-capacity-provider", "", "ECS capacity provider to launch the tasks (i.e. FARGATE_SPOT)")
+	flag.IntVar(&cfg.EcsConfig.MaxAttempts, "ecs-max-attempts", 5, "Maximum attempts for throttled or failed ECS API calls")
+	flag.DurationVar(&cfg.EcsConfig.CreateTimeout, "ecs-create-timeout", 0, "Maximum time to wait for an ECS task to be running")
+	flag.DurationVar(&cfg.EcsConfig.PollInitialInterval, "ecs-poll-initial-interval", time.Second, "Initial interval between the checks of the status of the ECS tasks")
+	flag.DurationVar(&cfg.EcsConfig.PollMaxInterval, "ecs-poll-max-interval", 10*time.Second, "Maximum interval between the checks of the status of the ECS tasks")
+	flag.StringVar(&cfg.DockerConfig.Host, "docker-host", "", "Address of the docker daemon (default: DOCKER_HOST)")
+	flag.StringVar(&cfg.DockerConfig.CertPath, "docker-cert-path", "", "Directory with the TLS certificates of the docker daemon (default: DOCKER_CERT_PATH)")
+	flag.BoolVar(&cfg.DockerConfig.AlwaysPull, "docker-always-pull", false, "Pull the task images even if they are present locally")
+	flag.BoolVar(&cfg.DockerConfig.AutoRemove, "docker-auto-remove", false, "Remove the docker containers once they exit")
+	flag.StringVar(&cfg.DockerConfig.NetworkName, "docker-network", "spark-network", "Docker network shared by the containers")
+	flag.BoolVar(&cfg.DockerConfig.ExternalNetwork, "docker-external-network", false, "Use an existing docker network instead of creating it")
+	flag.StringVar(&cfg.DockerConfig.RegistryUsername, "docker-registry-username", "", "Username of the private registry of the images")
+	flag.StringVar(&cfg.DockerConfig.RegistryPassword, "docker-registry-password", os.Getenv("DOCKER_REGISTRY_PASSWORD"), "Password of the private registry of the images (default: DOCKER_REGISTRY_PASSWORD)")
+	flag.StringVar(&cfg.DockerConfig.RegistryAuth, "docker-registry-auth", "", "Base64 encoded auth config of the private registry of the images")
+	flag.DurationVar(&cfg.DockerConfig.ReadyTimeout, "docker-ready-timeout", time.Minute, "Maximum time to wait for a docker container to be healthy or running")
+	flag.StringVar(&cfg.KubernetesConfig.Kubeconfig, "kubernetes-config", "", "Kubeconfig of the Kubernetes cluster (default: KUBECONFIG or ~/.kube/config)")
+	flag.StringVar(&cfg.KubernetesConfig.Namespace, "kubernetes-namespace", "", "Namespace of the pods in the Kubernetes cluster (default: the namespace of the context)")
+	flag.StringVar(&cfg.NomadConfig.Address, "nomad-addr", "", "Address of the Nomad API (default: NOMAD_ADDR or http://127.0.0.1:4646)")
+	flag.StringVar(&cfg.NomadConfig.Region, "nomad-region", "", "Nomad region of the jobs")
+	flag.StringVar(&cfg.NomadConfig.Namespace, "nomad-namespace", "", "Nomad namespace of the jobs")
+	flag.StringVar(&nomadDatacenters, "nomad-datacenters", "", "Comma separated list of Nomad datacenters to place the jobs")
+	flag.StringVar(&cfg.NomadConfig.NetworkMode, "nomad-network-mode", "host", "Docker network mode of the Nomad tasks")
 	flag.StringVar(&cfg.ControlPlaneAddr, "control-plane-addr", "", "")
+	flag.StringVar(&cfg.ListenAddr, "listen-addr", "0.0.0.0", "Address where the control plane API listens")
+	flag.IntVar(&cfg.Port, "port", 1323, "Port of the control plane API")
+	flag.StringVar(&cfg.TLSCertFile, "tls-cert-file", "", "TLS certificate to serve the control plane API over HTTPS")
+	flag.StringVar(&cfg.TLSKeyFile, "tls-key-file", "", "TLS key to serve the control plane API over HTTPS")
+	flag.StringVar(&namespaces, "namespaces", "", "Comma separated list of namespaces accepted by the control plane API, the jobs run in the first one (default: any)")
+	flag.StringVar(&cfg.AuthToken, "auth-token", "", "Bearer token required by the control plane API")
 	flag.Uint64Var(&cfg.Instances, "instances", 1, "")
+	flag.StringVar(&cfg.DeployMode, "deploy-mode", "client", "Deploy mode of spark-submit, client or cluster (the driver runs as a task)")
+	flag.StringVar(&jobsFile, "jobs-file", "", "Path to a JSON file with the list of jobs to submit")
+	flag.IntVar(&cfg.JobConcurrency, "job-concurrency", 0, "Maximum number of jobs running at the same time (0 means no limit)")
+	flag.StringVar(&cfg.SparkJob.Image, "spark-image", "", "Image of the Spark driver and executors (default: apache/spark:latest)")
+	flag.StringVar(&cfg.SparkJob.MainClass, "class", "", "Main class of the Spark application (default: SparkPi)")
+	flag.StringVar(&cfg.SparkJob.Application, "application", "", "Jar or .py file of the Spark application (default: the Spark examples jar)")
+	flag.StringVar(&pyFiles, "py-files", "", "Comma separated list of .py, .zip or .egg files for a Python application")
+	flag.Var(confFlag(cfg.SparkConf), "conf", "Spark configuration property (key=value) for spark-submit, can be repeated")
+	flag.Var(confFlag(cfg.GlobalEnv), "env", "Environment variable (key=value) for every task, can be repeated")
+	flag.StringVar(&cfg.PropertiesFile, "properties-file", "", "Path to a file with Spark configuration properties for spark-submit")
+	flag.StringVar(&cfg.LocalDirsPath, "local-dirs-path", "/tmp", "Path to remap SPARK_LOCAL_DIRS to in the executors")
+	flag.BoolVar(&cfg.DisableLocalDirsRemap, "disable-local-dirs-remap", false, "Do not remap SPARK_LOCAL_DIRS in the executors")
+	flag.StringVar(&cfg.RunAsUser, "run-as-user", "", "Default UID[:GID] to run the tasks as")
+	flag.StringVar(&dnsServers, "dns-servers", "", "Comma separated list of DNS servers for the tasks")
+	flag.DurationVar(&cfg.MaxTaskRuntime, "max-task-runtime", 0, "Maximum runtime of an executor task before it is stopped (0 disables it)")
+	flag.IntVar(&cfg.MaxConcurrentCreates, "max-concurrent-creates", 0, "Maximum number of tasks created in the providers at the same time, the rest are queued (0 means no limit)")
+	flag.StringVar(&cfg.LogDir, "log-dir", "logs", "Directory to write the logs of each run to")
+	flag.IntVar(&cfg.LogRetentionCount, "log-retention-count", 0, "Number of run log directories to keep (0 keeps all)")
+	flag.DurationVar(&cfg.LogRetentionAge, "log-retention-age", 0, "Maximum age of the run log directories to keep (0 keeps all)")
+	flag.StringVar(&cfg.TracingEndpoint, "tracing-endpoint", "", "OTLP HTTP endpoint (host:port) to export traces to")
+	flag.BoolVar(&cfg.TracingInsecure, "tracing-insecure", false, "Export traces without TLS")
+	flag.BoolVar(&cfg.StreamLogs, "stream-logs", false, "Tail the logs of the driver to stdout while the job runs")
+	flag.StringVar(&cfg.SummaryFile, "summary-file", "", "Path to write the JSON summary of the run to at shutdown")
+	flag.BoolVar(&cfg.MetricsEnabled, "metrics", false, "Expose Prometheus metrics in /metrics of the control plane API")
+	flag.IntVar(&cfg.RestartPolicy.MaxRestarts, "max-task-restarts", 0, "Number of times a failed executor task is restarted before its pod fails")
+	flag.DurationVar(&cfg.RestartPolicy.Backoff, "task-restart-backoff", 10*time.Second, "Wait before the first restart of a failed executor task, it doubles on every restart")
+	flag.DurationVar(&cfg.ShutdownGracePeriod, "shutdown-grace-period", 30*time.Second, "Maximum time to stop the tasks that are still running on shutdown")
+	flag.BoolVar(&cfg.CleanupOrphans, "cleanup-orphans", false, "Stop and remove the tasks left behind by previous runs (i.e. a crashed run) before the job starts")
+	flag.DurationVar(&cfg.ReconcileInterval, "reconcile-interval", 10*time.Second, "How often the phase of the pods is synced with the status of their tasks")
+	flag.StringVar(&logFormat, "log-format", "text", "Format of the logs, text or json")
+	flag.StringVar(&logLevel, "log-level", "info", "Minimum level of the logs (debug, info, warn or error)")
+	flag.BoolVar(&cfg.DryRun, "dry-run", false, "Log the tasks (provider, command and env) instead of creating them")
+	flag.IntVar(&benchmark, "benchmark", 0, "Launch N trivial tasks in the provider and report their startup latency")
+
+	// document the environment variable of every flag in the usage
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name != "conf" && f.Name != "env" {
+			f.Usage = strings.TrimSpace(f.Usage + " [$" + envName(f.Name) + "]")
+		}
+	})
 	flag.Parse()
 
+	// the values are applied with the precedence flags > env > config file > defaults,
+	// record the flags set in the command line to apply them over the others
+	explicit := map[string]string{}
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+	cliConf := map[string]string{}
+	for key, value := range cfg.SparkConf {
+		cliConf[key] = value
+	}
+	cliEnv := map[string]string{}
+	for key, value := range cfg.GlobalEnv {
+		cliEnv[key] = value
+	}
+
+	if _, ok := explicit["config"]; !ok {
+		configFile = os.Getenv(envName("config"))
+	}
+	if configFile != "" {
+		if err := sparkanywhere.ReadConfigFile(configFile, cfg); err != nil {
+			fmt.Printf("Error reading config file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var flagErr error
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name == "conf" || f.Name == "env" || f.Name == "config" || flagErr != nil {
+			return
+		}
+		value, ok := explicit[f.Name]
+		if !ok {
+			if value, ok = os.LookupEnv(envName(f.Name)); !ok {
+				return
+			}
+		}
+		if err := f.Value.Set(value); err != nil {
+			flagErr = fmt.Errorf("invalid value '%s' for %s: %w", value, f.Name, err)
+		}
+	})
+	if flagErr != nil {
+		fmt.Printf("Error: %v\n", flagErr)
+		os.Exit(1)
+	}
+	if cfg.SparkConf == nil {
+		cfg.SparkConf = map[string]string{}
+	}
+	for key, value := range cliConf {
+		cfg.SparkConf[key] = value
+	}
+	if cfg.GlobalEnv == nil {
+		cfg.GlobalEnv = map[string]string{}
+	}
+	for key, value := range cliEnv {
+		cfg.GlobalEnv[key] = value
+	}
+
+	// install the handler before anything logs so that the loggers of the
+	// providers (slog.With) inherit it
+	if err := setupLogger(logFormat, logLevel); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if !cfg.EcsEnabled && !cfg.DockerEnabled && !cfg.KubernetesEnabled && !cfg.NomadEnabled && !cfg.LocalEnabled {
+		fmt.Printf("Error: select a provider with --docker, --ecs, --kubernetes, --nomad or --local\n")
+		os.Exit(1)
+	}
+
+	if cfg.DryRun && benchmark != 0 {
+		fmt.Printf("Error: --dry-run cannot be used with --benchmark\n")
+		os.Exit(1)
+	}
+
+	if flag.NArg() != 0 {
+		cfg.SparkJob.Args = flag.Args()
+	}
+	if nomadDatacenters != "" {
+		cfg.NomadConfig.Datacenters = strings.Split(nomadDatacenters, ",")
+	}
+	if pyFiles != "" {
+		cfg.SparkJob.PyFiles = strings.Split(pyFiles, ",")
+	}
+	if namespaces != "" {
+		cfg.Namespaces = strings.Split(namespaces, ",")
+	}
+	if dnsServers != "" {
+		cfg.DNSServers = strings.Split(dnsServers, ",")
+	}
+	if jobsFile != "" {
+		jobs, err := sparkanywhere.ReadJobsFile(jobsFile)
+		if err != nil {
+			fmt.Printf("Error reading jobs file: %v\n", err)
+			os.Exit(1)
+		}
+		cfg.Jobs = jobs
+	}
+
 	var (
 		doneCh = make(chan struct{})
+		runErr error
 	)
 
 	sChan := make(chan os.Signal, 1)
@@ -37,19 +305,50 @@ func main() {
 		os.Exit(1)
 	}
 
+	if benchmark != 0 {
+		result, err := core.Benchmark(benchmark)
+		if err != nil {
+			fmt.Printf("Error running benchmark: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Print(result.String())
+		core.Close()
+		return
+	}
+
 	go func() {
-		if err := core.Run(); err != nil {
-			fmt.Printf("Error running sparkanywhere: %v\n", err)
+		if runErr = core.Run(); runErr != nil {
+			fmt.Printf("Error running sparkanywhere: %v\n", runErr)
 		}
 
 		close(doneCh)
 	}()
 
+	failed := false
 	select {
 	case <-doneCh:
+		failed = runErr != nil
 	case <-sChan:
 		fmt.Printf("Shutting down...\n")
 	}
 
-	core.GatherLogs()
+	// do not leave the tasks running if the run was interrupted
+	if err := core.StopTasks(); err != nil {
+		fmt.Printf("Error stopping tasks: %v\n", err)
+	}
+
+	// the summary is returned even if the logs of some tasks are missing
+	summary, err := core.GatherLogs()
+	if summary != nil {
+		fmt.Print(summary.String())
+	}
+	if err != nil {
+		fmt.Printf("Error gathering logs: %v\n", err)
+	}
+	core.Close()
+
+	// the jobs failed, i.e. spark exited with a non zero code
+	if failed {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,130 @@
+package sparkanywhere
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// taskRemover is implemented by the providers that leave the finished
+// tasks behind (i.e. stopped docker containers).
+type taskRemover interface {
+	RemoveTask(ctx context.Context, handle *taskHandle) error
+}
+
+// BenchmarkResult is the latency distribution of the benchmark tasks
+type BenchmarkResult struct {
+	Tasks  int
+	Failed int
+
+	// ToRunning is the time since the task is created until it is running
+	ToRunning []time.Duration
+
+	// ToCompletion is the time since the task is created until it finishes
+	ToCompletion []time.Duration
+}
+
+func (b *BenchmarkResult) String() string {
+	var str strings.Builder
+	fmt.Fprintf(&str, "tasks: %d, failed: %d\n", b.Tasks, b.Failed)
+	fmt.Fprintf(&str, "time to running:    %s\n", formatLatencies(b.ToRunning))
+	fmt.Fprintf(&str, "time to completion: %s\n", formatLatencies(b.ToCompletion))
+	return str.String()
+}
+
+func formatLatencies(durations []time.Duration) string {
+	if len(durations) == 0 {
+		return "n/a"
+	}
+	sorted := append([]time.Duration{}, durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	percentile := func(q float64) time.Duration {
+		return sorted[int(math.Ceil(q*float64(len(sorted))))-1]
+	}
+	round := func(d time.Duration) time.Duration {
+		return d.Round(time.Millisecond)
+	}
+	return fmt.Sprintf("p50=%s p95=%s max=%s", round(percentile(0.5)), round(percentile(0.95)), round(sorted[len(sorted)-1]))
+}
+
+// Benchmark launches n trivial tasks in the provider and measures how long
+// they take to be running and to complete.
+func (k *K8S) Benchmark(n int) (*BenchmarkResult, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("the number of benchmark tasks must be positive")
+	}
+
+	result := &BenchmarkResult{
+		Tasks: n,
+	}
+
+	var (
+		lock sync.Mutex
+		wg   sync.WaitGroup
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			toRunning, toCompletion, err := k.benchmarkTask(k.ctx, i)
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			if err != nil {
+				slog.Error("benchmark task failed", "index", i, "err", err)
+				result.Failed++
+				return
+			}
+			result.ToRunning = append(result.ToRunning, toRunning)
+			result.ToCompletion = append(result.ToCompletion, toCompletion)
+		}(i)
+	}
+	wg.Wait()
+
+	return result, nil
+}
+
+func (k *K8S) benchmarkTask(ctx context.Context, i int) (time.Duration, time.Duration, error) {
+	task := &Task{
+		Name:  fmt.Sprintf("benchmark-%d", i),
+		Image: "apache/spark",
+		Args: []string{
+			"/bin/bash",
+			"-c",
+			"echo hello",
+		},
+	}
+
+	start := time.Now()
+	handle, err := k.provider.CreateTask(ctx, task)
+	if err != nil {
+		return 0, 0, err
+	}
+	handle.Name = task.Name
+	toRunning := time.Since(start)
+
+	// the task is removed even if the wait fails or the benchmark is cancelled
+	defer func() {
+		if remover, ok := k.provider.(taskRemover); ok {
+			if err := remover.RemoveTask(context.WithoutCancel(ctx), handle); err != nil {
+				slog.Error("failed to remove benchmark task", "name", handle.Name, "err", err)
+			}
+		}
+	}()
+
+	if err := k.provider.WaitForTask(ctx, handle); err != nil {
+		return 0, 0, err
+	}
+	toCompletion := time.Since(start)
+
+	return toRunning, toCompletion, nil
+}
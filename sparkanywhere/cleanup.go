@@ -0,0 +1,55 @@
+package sparkanywhere
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// orphanLister is implemented by the providers that can find the tasks
+// launched by other runs than the current one (i.e. leftovers from a
+// crashed run)
+type orphanLister interface {
+	ListOrphanedTasks(ctx context.Context, currentRunId string) ([]*taskHandle, error)
+}
+
+// cleanupOrphans stops and removes the tasks left behind by other runs in
+// the providers that can list them. In dry run mode they are only logged.
+func (k *K8S) cleanupOrphans(ctx context.Context) error {
+	lister, ok := k.provider.(orphanLister)
+	if !ok {
+		return nil
+	}
+	orphans, err := lister.ListOrphanedTasks(ctx, k.runId)
+	if err != nil {
+		return fmt.Errorf("failed to list the orphaned tasks: %w", err)
+	}
+	if len(orphans) == 0 {
+		return nil
+	}
+	slog.Info("Cleaning up orphaned tasks...", "count", len(orphans))
+
+	var errs []error
+	for _, handle := range orphans {
+		if k.config.DryRun {
+			slog.Info("dry run: orphaned task not stopped", "name", handle.Name, "id", handle.ShortId, "provider", handle.Provider)
+			continue
+		}
+		slog.Info("stopping orphaned task", "name", handle.Name, "id", handle.ShortId, "provider", handle.Provider)
+
+		if err := k.provider.StopTask(ctx, handle); err != nil {
+			errs = append(errs, fmt.Errorf("%s (%s): %w", handle.Name, handle.ShortId, err))
+			continue
+		}
+		if remover, ok := k.provider.(taskRemover); ok {
+			if err := remover.RemoveTask(ctx, handle); err != nil {
+				errs = append(errs, fmt.Errorf("%s (%s): %w", handle.Name, handle.ShortId, err))
+			}
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("failed to clean up the orphaned tasks: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package sparkanywhere
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// ReadConfigFile reads a YAML or JSON file into config. The fields are the
+// json names of the Config fields and the durations can be written as
+// strings (i.e. "10m"). The fields that are not in the file are kept.
+func ReadConfigFile(path string, config *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("failed to decode config file: %w", err)
+	}
+	if err := parseDurations(raw, reflect.TypeOf(Config{})); err != nil {
+		return fmt.Errorf("failed to decode config file: %w", err)
+	}
+
+	if data, err = json.Marshal(raw); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(config); err != nil {
+		return fmt.Errorf("failed to decode config file: %w", err)
+	}
+	return nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// parseDurations replaces the string values of the duration fields of typ
+// in raw with their value in nanoseconds
+func parseDurations(raw map[string]interface{}, typ reflect.Type) error {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		value, ok := raw[name]
+		if name == "" || !ok {
+			continue
+		}
+
+		if field.Type == durationType {
+			if str, ok := value.(string); ok {
+				d, err := time.ParseDuration(str)
+				if err != nil {
+					return fmt.Errorf("invalid duration '%s' of %s: %w", str, name, err)
+				}
+				raw[name] = int64(d)
+			}
+			continue
+		}
+
+		fieldType := field.Type
+		for fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if nested, ok := value.(map[string]interface{}); ok && fieldType.Kind() == reflect.Struct {
+			if err := parseDurations(nested, fieldType); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package sparkanywhere
+
+import (
+	"net/http"
+	"runtime"
+
+	"github.com/labstack/echo"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/version"
+)
+
+// emulatedVersion is the Kubernetes version reported to the clients, the
+// one of the API types of the control plane
+var emulatedVersion = version.Info{
+	Major:      "1",
+	Minor:      "29",
+	GitVersion: "v1.29.1",
+	Platform:   runtime.GOOS + "/" + runtime.GOARCH,
+	GoVersion:  runtime.Version(),
+	Compiler:   runtime.Compiler,
+}
+
+func (k *K8S) getVersion(c echo.Context) error {
+	return c.JSON(http.StatusOK, emulatedVersion)
+}
+
+// getAPIVersions returns the versions of the core API group
+func (k *K8S) getAPIVersions(c echo.Context) error {
+	return c.JSON(http.StatusOK, metav1.APIVersions{
+		TypeMeta: metav1.TypeMeta{Kind: "APIVersions"},
+		Versions: []string{"v1"},
+		ServerAddressByClientCIDRs: []metav1.ServerAddressByClientCIDR{
+			{ClientCIDR: "0.0.0.0/0", ServerAddress: c.Request().Host},
+		},
+	})
+}
+
+// getAPIGroups returns the named API groups, there are none since only the
+// core group is served
+func (k *K8S) getAPIGroups(c echo.Context) error {
+	return c.JSON(http.StatusOK, metav1.APIGroupList{
+		TypeMeta: metav1.TypeMeta{Kind: "APIGroupList", APIVersion: "v1"},
+		Groups:   []metav1.APIGroup{},
+	})
+}
+
+// getAPIResources returns the resources of the core API group that the
+// control plane serves
+func (k *K8S) getAPIResources(c echo.Context) error {
+	return c.JSON(http.StatusOK, metav1.APIResourceList{
+		TypeMeta:     metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"},
+		GroupVersion: "v1",
+		APIResources: []metav1.APIResource{
+			{Name: "pods", SingularName: "pod", Namespaced: true, Kind: "Pod", Verbs: metav1.Verbs{"create", "delete", "deletecollection", "get", "list", "patch", "watch"}},
+			{Name: "configmaps", SingularName: "configmap", Namespaced: true, Kind: "ConfigMap", Verbs: metav1.Verbs{"create", "deletecollection", "get", "list", "patch"}},
+			{Name: "services", SingularName: "service", Namespaced: true, Kind: "Service", Verbs: metav1.Verbs{"create", "deletecollection", "patch"}},
+			{Name: "persistentvolumeclaims", SingularName: "persistentvolumeclaim", Namespaced: true, Kind: "PersistentVolumeClaim", Verbs: metav1.Verbs{"deletecollection"}},
+		},
+	})
+}
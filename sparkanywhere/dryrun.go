@@ -0,0 +1,35 @@
+package sparkanywhere
+
+import (
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// logDryRun logs the task that would be created in the provider. The auth
+// token is masked since it is part of the spark-submit command.
+func (k *K8S) logDryRun(task *Task) {
+	mask := func(s string) string {
+		if k.config.AuthToken == "" {
+			return s
+		}
+		return strings.ReplaceAll(s, k.config.AuthToken, "***")
+	}
+
+	provider := task.Provider
+	if provider == "" {
+		provider = k.defaultProvider
+	}
+
+	args := make([]string, len(task.Args))
+	for i, arg := range task.Args {
+		args[i] = mask(arg)
+	}
+	env := make([]string, 0, len(task.Env))
+	for name, value := range task.Env {
+		env = append(env, name+"="+mask(value))
+	}
+	sort.Strings(env)
+
+	slog.Info("dry run, not creating the task", "name", task.Name, "provider", provider, "image", task.Image, "cpu", task.Cpu, "memory", task.Memory, "args", args, "env", env)
+}
@@ -0,0 +1,185 @@
+package sparkanywhere
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+var (
+	defaultEcsPollInitialInterval = 1 * time.Second
+	defaultEcsPollMaxInterval     = 10 * time.Second
+
+	// ecsMaxDescribeTasks is the maximum number of tasks of a DescribeTasks call
+	ecsMaxDescribeTasks = 100
+)
+
+// describeTasksFn describes the tasks, it is the DescribeTasks call of the provider
+type describeTasksFn func(ctx context.Context, taskArns []string) (*ecs.DescribeTasksOutput, error)
+
+// ecsTaskPoller describes every waited task with a single DescribeTasks call
+// (per 100 tasks) on each interval and hands the result to its waiters, instead
+// of one call per task. It only polls while there are waiters. The interval
+// doubles after every round up to maxInterval and it is reset when a new task
+// is waited for, so that its first transitions are caught quickly.
+type ecsTaskPoller struct {
+	initialInterval time.Duration
+	maxInterval     time.Duration
+	describe        describeTasksFn
+
+	lock    sync.Mutex
+	waiters map[string][]chan ecsPollResult
+	running bool
+
+	// polled are the tasks described in the last round
+	polled map[string]struct{}
+
+	// newTaskCh wakes up the poller when a new task is waited for
+	newTaskCh chan struct{}
+}
+
+type ecsPollResult struct {
+	task *ecs.Task
+	err  error
+}
+
+func newEcsTaskPoller(initialInterval, maxInterval time.Duration, describe describeTasksFn) *ecsTaskPoller {
+	return &ecsTaskPoller{
+		initialInterval: initialInterval,
+		maxInterval:     maxInterval,
+		describe:        describe,
+		waiters:         map[string][]chan ecsPollResult{},
+		polled:          map[string]struct{}{},
+		newTaskCh:       make(chan struct{}, 1),
+	}
+}
+
+// poll waits for the next round and returns the task as described in it
+func (p *ecsTaskPoller) poll(ctx context.Context, taskArn string) (*ecs.Task, error) {
+	resultCh := make(chan ecsPollResult, 1)
+
+	p.lock.Lock()
+	p.waiters[taskArn] = append(p.waiters[taskArn], resultCh)
+	if !p.running {
+		p.running = true
+		go p.run()
+	} else if _, ok := p.polled[taskArn]; !ok {
+		select {
+		case p.newTaskCh <- struct{}{}:
+		default:
+		}
+	}
+	p.lock.Unlock()
+
+	select {
+	case result := <-resultCh:
+		return result.task, result.err
+	case <-ctx.Done():
+		p.removeWaiter(taskArn, resultCh)
+		return nil, ctx.Err()
+	}
+}
+
+func (p *ecsTaskPoller) removeWaiter(taskArn string, resultCh chan ecsPollResult) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	waiters := p.waiters[taskArn]
+	for i, ch := range waiters {
+		if ch == resultCh {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(p.waiters, taskArn)
+	} else {
+		p.waiters[taskArn] = waiters
+	}
+}
+
+// run polls the waited tasks with backoff until there are no waiters
+func (p *ecsTaskPoller) run() {
+	interval := p.initialInterval
+	next := time.Now().Add(interval)
+
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-p.newTaskCh:
+			timer.Stop()
+
+			// poll the new task soon without delaying the round
+			interval = p.initialInterval
+			if soon := time.Now().Add(interval); soon.Before(next) {
+				next = soon
+			}
+			continue
+		}
+
+		p.lock.Lock()
+		waiters := p.waiters
+		p.waiters = map[string][]chan ecsPollResult{}
+		p.polled = map[string]struct{}{}
+		if len(waiters) == 0 {
+			p.running = false
+			p.lock.Unlock()
+			return
+		}
+
+		taskArns := make([]string, 0, len(waiters))
+		for taskArn := range waiters {
+			taskArns = append(taskArns, taskArn)
+			p.polled[taskArn] = struct{}{}
+		}
+		p.lock.Unlock()
+		sort.Strings(taskArns)
+
+		for len(taskArns) != 0 {
+			n := min(len(taskArns), ecsMaxDescribeTasks)
+			p.pollTasks(taskArns[:n], waiters)
+			taskArns = taskArns[n:]
+		}
+
+		interval = min(2*interval, p.maxInterval)
+		next = time.Now().Add(interval)
+	}
+}
+
+// pollTasks describes the tasks and sends the result to their waiters
+func (p *ecsTaskPoller) pollTasks(taskArns []string, waiters map[string][]chan ecsPollResult) {
+	output, err := p.describe(context.Background(), taskArns)
+
+	tasks := map[string]*ecs.Task{}
+	failures := map[string]string{}
+	if err == nil {
+		for _, task := range output.Tasks {
+			tasks[aws.StringValue(task.TaskArn)] = task
+		}
+		for _, failure := range output.Failures {
+			failures[aws.StringValue(failure.Arn)] = aws.StringValue(failure.Reason)
+		}
+	}
+
+	for _, taskArn := range taskArns {
+		var result ecsPollResult
+		if err != nil {
+			result.err = err
+		} else if task, ok := tasks[taskArn]; ok {
+			result.task = task
+		} else if reason, ok := failures[taskArn]; ok {
+			result.err = fmt.Errorf("failed to describe task %s: %s", taskArn, reason)
+		} else {
+			result.err = fmt.Errorf("task %s not found", taskArn)
+		}
+		for _, resultCh := range waiters[taskArn] {
+			resultCh <- result
+		}
+	}
+}
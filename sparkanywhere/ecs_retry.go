@@ -0,0 +1,75 @@
+package sparkanywhere
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+var (
+	defaultEcsMaxAttempts = 5
+
+	ecsRetryBaseDelay = 200 * time.Millisecond
+	ecsRetryMaxDelay  = 10 * time.Second
+)
+
+// ecsRetryableCodes are the AWS error codes of transient errors
+var ecsRetryableCodes = map[string]struct{}{
+	"ThrottlingException":         {},
+	"Throttling":                  {},
+	"TooManyRequestsException":    {},
+	"RequestLimitExceeded":        {},
+	"ServiceUnavailable":          {},
+	"ServiceUnavailableException": {},
+	"ServerException":             {},
+	"InternalFailure":             {},
+}
+
+// isEcsRetryable returns true if the error is a throttling or a server (5xx) error
+func isEcsRetryable(err error) bool {
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) && reqErr.StatusCode() >= 500 {
+		return true
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		_, ok := ecsRetryableCodes[awsErr.Code()]
+		return ok
+	}
+	return false
+}
+
+// retryEcs calls fn until it succeeds, it returns a non retryable error or it
+// reaches maxAttempts. It waits with exponential backoff and full jitter
+// between attempts.
+func retryEcs(ctx context.Context, maxAttempts int, fn func() error) error {
+	if maxAttempts <= 0 {
+		maxAttempts = defaultEcsMaxAttempts
+	}
+
+	var err error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if err = fn(); err == nil || !isEcsRetryable(err) {
+			return err
+		}
+		if attempt == maxAttempts-1 {
+			break
+		}
+
+		delay := ecsRetryBaseDelay << attempt
+		if delay > ecsRetryMaxDelay || delay <= 0 {
+			delay = ecsRetryMaxDelay
+		}
+		delay = time.Duration(rand.Int63n(int64(delay)))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+	return err
+}
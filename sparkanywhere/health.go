@@ -0,0 +1,37 @@
+package sparkanywhere
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// pinger is implemented by the providers that can check that their API is
+// reachable. The providers that do not implement it are always ready.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// readyTimeout bounds the time to check that the providers are reachable
+var readyTimeout = 5 * time.Second
+
+// getHealthz reports that the control plane is alive
+func (k *K8S) getHealthz(c echo.Context) error {
+	return c.String(http.StatusOK, "ok")
+}
+
+// getReadyz reports that the control plane is ready, that is, the API of
+// every provider is reachable
+func (k *K8S) getReadyz(c echo.Context) error {
+	if p, ok := k.provider.(pinger); ok {
+		ctx, cancel := context.WithTimeout(c.Request().Context(), readyTimeout)
+		defer cancel()
+
+		if err := p.Ping(ctx); err != nil {
+			return c.String(http.StatusServiceUnavailable, err.Error())
+		}
+	}
+	return c.String(http.StatusOK, "ok")
+}
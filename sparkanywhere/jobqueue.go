@@ -0,0 +1,319 @@
+package sparkanywhere
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JobSpec is a Spark job to submit
+type JobSpec struct {
+	// Name is the name of the Spark application and its driver task
+	Name string `json:"name"`
+
+	// DependsOn are the jobs that must succeed before this one starts
+	DependsOn []string `json:"dependsOn,omitempty"`
+
+	// Conf are extra --conf entries for the job. They take precedence
+	// over the ones in Config.
+	Conf map[string]string `json:"conf,omitempty"`
+
+	// SparkJob overrides the fields of Config.SparkJob that are set
+	SparkJob
+}
+
+// SparkJob is the Spark application submitted with spark-submit
+type SparkJob struct {
+	// Image is the image of the driver and the executors
+	Image string `json:"image,omitempty"`
+
+	// MainClass is the --class of the application
+	MainClass string `json:"mainClass,omitempty"`
+
+	// Application is the jar or the .py file of the application, relative
+	// to the Spark home of the image or a URL (i.e. local://, s3a://)
+	Application string `json:"application,omitempty"`
+
+	// PyFiles are the --py-files of a Python application
+	PyFiles []string `json:"pyFiles,omitempty"`
+
+	// Args are the arguments of the application
+	Args []string `json:"args,omitempty"`
+}
+
+var (
+	defaultSparkImage       = "apache/spark:latest"
+	defaultSparkMainClass   = "org.apache.spark.examples.SparkPi"
+	defaultSparkApplication = "./examples/jars/spark-examples_2.12-3.5.0.jar"
+)
+
+// merge returns the job with the fields of override that are set
+func (s SparkJob) merge(override SparkJob) SparkJob {
+	if override.Image != "" {
+		s.Image = override.Image
+	}
+	if override.MainClass != "" {
+		s.MainClass = override.MainClass
+	}
+	if override.Application != "" {
+		s.Application = override.Application
+	}
+	if len(override.PyFiles) != 0 {
+		s.PyFiles = override.PyFiles
+	}
+	if len(override.Args) != 0 {
+		s.Args = override.Args
+	}
+	return s
+}
+
+// isPython returns true if the application is a PySpark script
+func (s SparkJob) isPython() bool {
+	return strings.HasSuffix(strings.ToLower(s.Application), ".py")
+}
+
+// withDefaults returns the job with the SparkPi example for the fields
+// that are not set
+func (s SparkJob) withDefaults() SparkJob {
+	if s.Image == "" {
+		s.Image = defaultSparkImage
+	}
+	if s.Application == "" {
+		s.Application = defaultSparkApplication
+		if s.MainClass == "" {
+			s.MainClass = defaultSparkMainClass
+		}
+	}
+	return s
+}
+
+// ReadJobsFile reads a JSON file with a list of job specs
+func ReadJobsFile(path string) ([]*JobSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []*JobSpec
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return nil, fmt.Errorf("failed to decode jobs file: %w", err)
+	}
+	return jobs, nil
+}
+
+type JobStatus string
+
+const (
+	JobPending   JobStatus = "pending"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+
+	// JobSkipped is the status of a job whose dependencies failed or that
+	// did not start before the queue was stopped
+	JobSkipped JobStatus = "skipped"
+)
+
+type JobState struct {
+	Name       string     `json:"name"`
+	Status     JobStatus  `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+// jobQueue runs a list of jobs with a concurrency limit and in the order
+// defined by their dependencies
+type jobQueue struct {
+	jobs        []*JobSpec
+	concurrency int
+
+	lock   sync.Mutex
+	states map[string]*JobState
+
+	// stopped is set on shutdown so that no more jobs are started
+	stopped bool
+}
+
+func newJobQueue(jobs []*JobSpec, concurrency int) (*jobQueue, error) {
+	q := &jobQueue{
+		jobs:        jobs,
+		concurrency: concurrency,
+		states:      map[string]*JobState{},
+	}
+
+	byName := map[string]*JobSpec{}
+	for _, job := range jobs {
+		if job.Name == "" {
+			return nil, fmt.Errorf("job name is empty")
+		}
+		if _, ok := byName[job.Name]; ok {
+			return nil, fmt.Errorf("duplicated job '%s'", job.Name)
+		}
+		byName[job.Name] = job
+		q.states[job.Name] = &JobState{Name: job.Name, Status: JobPending}
+	}
+	for _, job := range jobs {
+		for _, dep := range job.DependsOn {
+			if _, ok := byName[dep]; !ok {
+				return nil, fmt.Errorf("job '%s' depends on unknown job '%s'", job.Name, dep)
+			}
+		}
+	}
+
+	// check that there are no dependency cycles
+	visited := map[string]int{}
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch visited[name] {
+		case 1:
+			return fmt.Errorf("dependency cycle on job '%s'", name)
+		case 2:
+			return nil
+		}
+		visited[name] = 1
+		for _, dep := range byName[name].DependsOn {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		visited[name] = 2
+		return nil
+	}
+	for _, job := range jobs {
+		if err := visit(job.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	return q, nil
+}
+
+// Stats returns the state of all the jobs
+func (q *jobQueue) Stats() []JobState {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	stats := []JobState{}
+	for _, job := range q.jobs {
+		stats = append(stats, *q.states[job.Name])
+	}
+	return stats
+}
+
+type jobResult struct {
+	name string
+	err  error
+}
+
+// run deploys the jobs until all of them are finished or skipped.
+func (q *jobQueue) run(ctx context.Context, deploy func(context.Context, *JobSpec) error) error {
+	doneCh := make(chan jobResult)
+	running := 0
+
+	for {
+		q.lock.Lock()
+		q.skipFailedDependencies()
+
+		for _, job := range q.jobs {
+			if q.concurrency > 0 && running >= q.concurrency {
+				break
+			}
+			state := q.states[job.Name]
+			if state.Status != JobPending {
+				continue
+			}
+			if q.stopped {
+				state.Status = JobSkipped
+				continue
+			}
+			if !q.dependenciesSucceeded(job) {
+				continue
+			}
+
+			now := time.Now()
+			state.Status = JobRunning
+			state.StartedAt = &now
+			running++
+
+			go func(job *JobSpec) {
+				doneCh <- jobResult{name: job.Name, err: deploy(ctx, job)}
+			}(job)
+		}
+		q.lock.Unlock()
+
+		if running == 0 {
+			break
+		}
+
+		res := <-doneCh
+		running--
+
+		q.lock.Lock()
+		now := time.Now()
+		state := q.states[res.name]
+		state.FinishedAt = &now
+		if res.err != nil {
+			slog.Error("job failed", "name", res.name, "err", res.err)
+			state.Status = JobFailed
+			state.Error = res.err.Error()
+		} else {
+			state.Status = JobSucceeded
+		}
+		q.lock.Unlock()
+	}
+
+	failed := []string{}
+	for _, state := range q.Stats() {
+		if state.Status != JobSucceeded {
+			failed = append(failed, fmt.Sprintf("%s (%s)", state.Name, state.Status))
+		}
+	}
+	if len(failed) != 0 {
+		return fmt.Errorf("jobs did not succeed: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// stop skips the pending jobs, the running jobs are not interrupted
+func (q *jobQueue) stop() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.stopped = true
+}
+
+// skipFailedDependencies marks as skipped the pending jobs with a failed or
+// skipped dependency. It must be called with the lock held.
+func (q *jobQueue) skipFailedDependencies() {
+	for changed := true; changed; {
+		changed = false
+		for _, job := range q.jobs {
+			state := q.states[job.Name]
+			if state.Status != JobPending {
+				continue
+			}
+			for _, dep := range job.DependsOn {
+				if status := q.states[dep].Status; status == JobFailed || status == JobSkipped {
+					state.Status = JobSkipped
+					changed = true
+					break
+				}
+			}
+		}
+	}
+}
+
+// dependenciesSucceeded must be called with the lock held
+func (q *jobQueue) dependenciesSucceeded(job *JobSpec) bool {
+	for _, dep := range job.DependsOn {
+		if q.states[dep].Status != JobSucceeded {
+			return false
+		}
+	}
+	return true
+}
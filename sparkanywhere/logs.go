@@ -0,0 +1,129 @@
+package sparkanywhere
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// stdLogsGetter is implemented by the providers that keep the stdout and
+// stderr of the tasks apart.
+type stdLogsGetter interface {
+	GetStdLogs(ctx context.Context, handle *taskHandle) (stdout string, stderr string, err error)
+}
+
+var errStdLogsNotSupported = errors.New("separate stdout and stderr logs are not supported by the provider")
+
+// logFileName is the name of the log files of the task without the extension,
+// the restarted tasks of a pod are suffixed with the number of the restart
+func logFileName(handle *taskHandle) string {
+	if handle.Restarts != 0 {
+		return handle.Name + "." + strconv.Itoa(handle.Restarts)
+	}
+	return handle.Name
+}
+
+// writeTaskLogs writes the logs of the task in logDir and returns the paths
+// of the files. If the provider keeps stdout and stderr apart they are written
+// to <name>.out and <name>.err, otherwise the logs are written to <name>.log.
+func (k *K8S) writeTaskLogs(ctx context.Context, logDir string, handle *taskHandle) ([]string, error) {
+	if getter, ok := k.provider.(stdLogsGetter); ok {
+		stdout, stderr, err := getter.GetStdLogs(ctx, handle)
+		if err == nil {
+			outPath := filepath.Join(logDir, logFileName(handle)+".out")
+			if err := os.WriteFile(outPath, []byte(stdout), 0644); err != nil {
+				return nil, err
+			}
+			errPath := filepath.Join(logDir, logFileName(handle)+".err")
+			if err := os.WriteFile(errPath, []byte(stderr), 0644); err != nil {
+				return nil, err
+			}
+			return []string{outPath, errPath}, nil
+		}
+		if !errors.Is(err, errStdLogsNotSupported) {
+			return nil, err
+		}
+	}
+
+	logs, err := k.provider.GetLogs(ctx, handle)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(logDir, logFileName(handle)+".log")
+	if err := os.WriteFile(path, []byte(logs), 0644); err != nil {
+		return nil, err
+	}
+	return []string{path}, nil
+}
+
+// writeLogsError writes the error of fetching the logs of the task in logDir
+// to <name>.error, so that the missing logs are noticed next to the others
+func writeLogsError(logDir string, handle *taskHandle, logsErr error) (string, error) {
+	path := filepath.Join(logDir, logFileName(handle)+".error")
+	if err := os.WriteFile(path, []byte(logsErr.Error()+"\n"), 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// pruneLogDirs removes the run log directories under logDir that exceed the
+// retention count or are older than the retention age. The directory of
+// the current run is never removed. A zero count or age disables that limit.
+func pruneLogDirs(logDir string, currentRunDir string, count int, age time.Duration) error {
+	if count <= 0 && age <= 0 {
+		return nil
+	}
+
+	entries, err := os.ReadDir(logDir)
+	if err != nil {
+		return err
+	}
+
+	type runDir struct {
+		name      string
+		timestamp time.Time
+	}
+
+	// the run directories are named after the unix milliseconds of the run
+	runDirs := []runDir{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		millis, err := strconv.ParseInt(entry.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+		runDirs = append(runDirs, runDir{name: entry.Name(), timestamp: time.UnixMilli(millis)})
+	}
+
+	// newest first
+	sort.Slice(runDirs, func(i, j int) bool {
+		return runDirs[i].timestamp.After(runDirs[j].timestamp)
+	})
+
+	now := time.Now()
+	for i, dir := range runDirs {
+		path := filepath.Join(logDir, dir.name)
+		if path == filepath.Clean(currentRunDir) {
+			continue
+		}
+
+		expiredCount := count > 0 && i >= count
+		expiredAge := age > 0 && now.Sub(dir.timestamp) > age
+		if !expiredCount && !expiredAge {
+			continue
+		}
+
+		slog.Info("Removing old log directory", "path", path)
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package sparkanywhere
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+var logStreamInterval = 2 * time.Second
+
+// logStreamer is implemented by the providers that can tail the logs of
+// a task while it runs. StreamLogs returns once the task is stopped and
+// all its logs are written.
+type logStreamer interface {
+	StreamLogs(ctx context.Context, handle *taskHandle, w io.Writer) error
+}
+
+var errStreamLogsNotSupported = errors.New("streaming logs is not supported by the provider")
+
+// streamLogs streams the log lines of all the tasks as Server-Sent Events.
+// Each line is prefixed with the name of its pod and it can be filtered
+// to a single pod with the 'pod' query parameter.
+func (k *K8S) streamLogs(c echo.Context) error {
+	podFilter := c.QueryParam("pod")
+
+	ctx, cancel := context.WithCancel(c.Request().Context())
+	defer cancel()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	// each task is followed in its own goroutine, the new tasks are
+	// picked up on every tick
+	followed := map[*taskHandle]struct{}{}
+	linesCh := make(chan string)
+
+	ticker := time.NewTicker(logStreamInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, handle := range k.getHandles() {
+			if podFilter != "" && handle.Name != podFilter {
+				continue
+			}
+			if _, ok := followed[handle]; ok {
+				continue
+			}
+			followed[handle] = struct{}{}
+
+			go func(handle *taskHandle) {
+				w := &sseLineWriter{ctx: ctx, name: handle.Name, linesCh: linesCh}
+				if err := k.followLogs(ctx, handle, w); err != nil && ctx.Err() == nil {
+					slog.Debug("failed to follow logs", "name", handle.Name, "err", err)
+				}
+			}(handle)
+		}
+
+	WAIT:
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case line := <-linesCh:
+				if _, err := fmt.Fprint(res, line); err != nil {
+					return nil
+				}
+				res.Flush()
+			case <-ticker.C:
+				break WAIT
+			}
+		}
+	}
+}
+
+// followLogs writes the logs of the task to w until it is stopped. The
+// providers that cannot follow the logs are polled every logStreamInterval.
+func (k *K8S) followLogs(ctx context.Context, handle *taskHandle, w io.Writer) error {
+	if streamer, ok := k.provider.(logStreamer); ok {
+		err := streamer.StreamLogs(ctx, handle, w)
+		if !errors.Is(err, errStreamLogsNotSupported) {
+			return err
+		}
+	}
+
+	// offset is the position in the logs that has already been written
+	offset := 0
+	for {
+		// check if the task is stopped before reading the logs so that
+		// its last lines are written
+		k.handlesLock.Lock()
+		stopped := !handle.StoppedAt.IsZero()
+		k.handlesLock.Unlock()
+
+		logs, err := k.provider.GetLogs(ctx, handle)
+		if err != nil {
+			return err
+		}
+		if len(logs) > offset {
+			if _, err := io.WriteString(w, logs[offset:]); err != nil {
+				return err
+			}
+			offset = len(logs)
+		}
+		if stopped {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(logStreamInterval):
+		}
+	}
+}
+
+// sseLineWriter sends every complete line written to it as a Server-Sent
+// Event prefixed with the name of the pod
+type sseLineWriter struct {
+	ctx     context.Context
+	name    string
+	linesCh chan<- string
+	partial []byte
+}
+
+func (s *sseLineWriter) Write(b []byte) (int, error) {
+	s.partial = append(s.partial, b...)
+	for {
+		indx := bytes.IndexByte(s.partial, '\n')
+		if indx == -1 {
+			return len(b), nil
+		}
+		line := strings.TrimSuffix(string(s.partial[:indx]), "\r")
+		s.partial = s.partial[indx+1:]
+
+		select {
+		case s.linesCh <- fmt.Sprintf("data: [%s] %s\n\n", s.name, line):
+		case <-s.ctx.Done():
+			return 0, s.ctx.Err()
+		}
+	}
+}
+
+// streamTaskLogs tails the logs of the task to stdout. The returned channel
+// is closed once the stream is finished.
+func (k *K8S) streamTaskLogs(ctx context.Context, handle *taskHandle) <-chan struct{} {
+	doneCh := make(chan struct{})
+
+	go func() {
+		defer close(doneCh)
+
+		streamer, ok := k.provider.(logStreamer)
+		if !ok {
+			slog.Warn("failed to stream logs", "name", handle.Name, "err", errStreamLogsNotSupported)
+			return
+		}
+		if err := streamer.StreamLogs(ctx, handle, os.Stdout); err != nil && ctx.Err() == nil {
+			slog.Warn("failed to stream logs", "name", handle.Name, "err", err)
+		}
+	}()
+
+	return doneCh
+}
@@ -0,0 +1,46 @@
+package sparkanywhere
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestStreamLogs(t *testing.T) {
+	k, fake := newTestK8S(t, &Config{})
+	fake.Logs["exec-1"] = "line 1\nline 2\npartial"
+	fake.Logs["exec-2"] = "other\n"
+
+	for _, name := range []string{"exec-1", "exec-2"} {
+		serve(t, k.postPods, http.MethodPost, echo.MIMEApplicationJSON, testPod(name), "default")
+		waitFor(t, "the pod to run", func() bool { return k.podPhase("default", name) == v1.PodRunning })
+		if err := fake.Exit(name, 0); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "the pod to finish", func() bool { return k.podPhase("default", name) == "" })
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	req := httptest.NewRequest(http.MethodGet, "/logs/stream?pod=exec-1", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	if err := k.streamLogs(echo.New().NewContext(req, rec)); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the complete lines of the selected pod are sent
+	expected := "data: [exec-1] line 1\n\ndata: [exec-1] line 2\n\n"
+	if body := rec.Body.String(); body != expected {
+		t.Fatalf("expected %q, got %q", expected, body)
+	}
+	if contentType := rec.Header().Get(echo.HeaderContentType); !strings.HasPrefix(contentType, "text/event-stream") {
+		t.Fatalf("unexpected content type %s", contentType)
+	}
+}
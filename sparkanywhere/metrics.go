@@ -0,0 +1,184 @@
+package sparkanywhere
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// metrics are the counters of the control plane exposed in the Prometheus
+// text format in GET /metrics
+type metrics struct {
+	lock sync.Mutex
+
+	tasksCreated      uint64
+	tasksFailed       uint64
+	podCreateFailures uint64
+
+	taskCreateDuration *histogram
+	taskDuration       *histogram
+
+	// requests are the API requests by method, route and status code
+	requests map[requestKey]uint64
+}
+
+type requestKey struct {
+	method string
+	path   string
+	code   int
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		taskCreateDuration: newHistogram([]float64{0.5, 1, 2.5, 5, 10, 30, 60, 120}),
+		taskDuration:       newHistogram([]float64{10, 30, 60, 300, 600, 1800, 3600, 7200}),
+		requests:           map[requestKey]uint64{},
+	}
+}
+
+func (m *metrics) taskCreated(duration time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.tasksCreated++
+	m.taskCreateDuration.observe(duration.Seconds())
+}
+
+func (m *metrics) taskCreateFailed() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.tasksFailed++
+}
+
+func (m *metrics) taskFinished(duration time.Duration, failed bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if failed {
+		m.tasksFailed++
+	}
+	m.taskDuration.observe(duration.Seconds())
+}
+
+func (m *metrics) podCreateFailed() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.podCreateFailures++
+}
+
+func (m *metrics) request(method, path string, code int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.requests[requestKey{method: method, path: path, code: code}]++
+}
+
+// middleware counts the API requests once they are handled
+func (m *metrics) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := next(c)
+
+		code := c.Response().Status
+		if err != nil {
+			code = http.StatusInternalServerError
+			if httpErr, ok := err.(*echo.HTTPError); ok {
+				code = httpErr.Code
+			}
+		}
+		m.request(c.Request().Method, c.Path(), code)
+		return err
+	}
+}
+
+// write writes the metrics in the Prometheus text format
+func (m *metrics) write(b *strings.Builder, activeWatches int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	writeMetric(b, "sparkanywhere_tasks_created_total", "counter", "Number of tasks created in the providers", m.tasksCreated)
+	writeMetric(b, "sparkanywhere_tasks_failed_total", "counter", "Number of tasks that failed to be created or exited with an error", m.tasksFailed)
+	writeMetric(b, "sparkanywhere_pod_create_failures_total", "counter", "Number of pods that failed to be created", m.podCreateFailures)
+	writeMetric(b, "sparkanywhere_active_watches", "gauge", "Number of open pod watches", activeWatches)
+	m.taskCreateDuration.write(b, "sparkanywhere_task_create_duration_seconds", "Time to create a task in the provider")
+	m.taskDuration.write(b, "sparkanywhere_task_duration_seconds", "Time from the creation of a task until it exits")
+
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].path != keys[j].path {
+			return keys[i].path < keys[j].path
+		}
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].code < keys[j].code
+	})
+
+	fmt.Fprintf(b, "# HELP sparkanywhere_api_requests_total Number of requests to the control plane API\n")
+	fmt.Fprintf(b, "# TYPE sparkanywhere_api_requests_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(b, "sparkanywhere_api_requests_total{method=%q,path=%q,code=\"%d\"} %d\n", key.method, key.path, key.code, m.requests[key])
+	}
+}
+
+func writeMetric(b *strings.Builder, name, typ, help string, value interface{}) {
+	fmt.Fprintf(b, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(b, "# TYPE %s %s\n", name, typ)
+	fmt.Fprintf(b, "%s %v\n", name, value)
+}
+
+// histogram is a Prometheus histogram with fixed buckets
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) observe(value float64) {
+	for i, bucket := range h.buckets {
+		if value <= bucket {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (h *histogram) write(b *strings.Builder, name, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(b, "# TYPE %s histogram\n", name)
+	for i, bucket := range h.buckets {
+		fmt.Fprintf(b, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bucket, 'g', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(b, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(b, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(b, "%s_count %d\n", name, h.count)
+}
+
+func (k *K8S) getMetrics(c echo.Context) error {
+	k.createLock.Lock()
+	activeWatches := len(k.updateCh)
+	k.createLock.Unlock()
+
+	var b strings.Builder
+	k.metrics.write(&b, activeWatches)
+	return c.Blob(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(b.String()))
+}
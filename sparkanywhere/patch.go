@@ -0,0 +1,100 @@
+package sparkanywhere
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// isMergePatch returns true for the JSON merge and the strategic merge patches.
+// The strategic merge patches are applied as JSON merge patches, which is the
+// same for the maps of the metadata (labels and annotations) but the lists
+// are replaced instead of merged by key and the $patch directives are not
+// supported.
+func isMergePatch(contentType string) bool {
+	return strings.HasPrefix(contentType, "application/merge-patch+json") || strings.HasPrefix(contentType, "application/strategic-merge-patch+json")
+}
+
+// mergePatch applies a JSON merge patch (RFC 7386) to the original document
+func mergePatch(original, patch []byte) ([]byte, error) {
+	var doc, patchDoc interface{}
+	if err := json.Unmarshal(original, &doc); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(patch, &patchDoc); err != nil {
+		return nil, fmt.Errorf("invalid patch: %w", err)
+	}
+	return json.Marshal(mergePatchValue(doc, patchDoc))
+}
+
+func mergePatchValue(doc, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	docObj, ok := doc.(map[string]interface{})
+	if !ok {
+		docObj = map[string]interface{}{}
+	}
+	for key, value := range patchObj {
+		if value == nil {
+			delete(docObj, key)
+			continue
+		}
+		docObj[key] = mergePatchValue(docObj[key], value)
+	}
+	return docObj
+}
+
+// mergePatchPod applies a merge patch to the metadata of a stored pod. Like
+// the main resource of a pod in Kubernetes, the changes to the status are
+// ignored and the spec of the running task cannot change.
+func (k *K8S) mergePatchPod(c echo.Context) error {
+	name := c.Param("name")
+
+	data, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return err
+	}
+
+	k.createLock.Lock()
+	pod := k.findPod(c.Param("namespace"), name)
+	if pod == nil {
+		k.createLock.Unlock()
+		return statusError(c, http.StatusNotFound, metav1.StatusReasonNotFound, fmt.Sprintf("pods \"%s\" not found", name))
+	}
+
+	original, err := json.Marshal(pod)
+	if err != nil {
+		k.createLock.Unlock()
+		return err
+	}
+	patched, err := mergePatch(original, data)
+	if err != nil {
+		k.createLock.Unlock()
+		return statusError(c, http.StatusBadRequest, metav1.StatusReasonBadRequest, err.Error())
+	}
+	var meta struct {
+		ObjectMeta metav1.ObjectMeta `json:"metadata"`
+	}
+	if err := json.Unmarshal(patched, &meta); err != nil {
+		k.createLock.Unlock()
+		return statusError(c, http.StatusBadRequest, metav1.StatusReasonBadRequest, err.Error())
+	}
+
+	pod.ObjectMeta.Labels = meta.ObjectMeta.Labels
+	pod.ObjectMeta.Annotations = meta.ObjectMeta.Annotations
+	pod.ObjectMeta.OwnerReferences = meta.ObjectMeta.OwnerReferences
+	pod.ObjectMeta.Finalizers = meta.ObjectMeta.Finalizers
+	k.emitEvent("MODIFIED", pod)
+
+	result := *pod.DeepCopy()
+	k.createLock.Unlock()
+
+	return c.JSON(http.StatusOK, result)
+}
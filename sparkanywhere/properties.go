@@ -0,0 +1,43 @@
+package sparkanywhere
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// readPropertiesFile parses a spark-defaults.conf style file. Each line is
+// either 'key value' or 'key=value', blank lines and lines starting
+// with '#' or '!' are ignored.
+func readPropertiesFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	props := map[string]string{}
+
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+			continue
+		}
+
+		// the key ends at the first '=' or whitespace
+		i := strings.IndexAny(line, "= \t")
+		if i == -1 {
+			return nil, fmt.Errorf("%s:%d: no value for property '%s'", path, lineNum, line)
+		}
+		key, value := line[:i], strings.TrimSpace(line[i:])
+		value = strings.TrimSpace(strings.TrimPrefix(value, "="))
+
+		props[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return props, nil
+}
@@ -1,98 +1,837 @@
 package sparkanywhere
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/registry"
 	"github.com/docker/docker/api/types/strslice"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/nat"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type dockerProvider struct {
 	logger *slog.Logger
+	config *DockerConfig
 	cli    *client.Client
+
+	// pulledImages are the images already pulled in this run
+	pulledImages     map[string]struct{}
+	pulledImagesLock sync.Mutex
+
+	// logs are the logs kept in memory of the containers that are (or
+	// will be) removed
+	logs     map[string]*dockerTaskLogs
+	logsLock sync.Mutex
+
+	// exitCodes are the exit codes of the waited containers, which can be
+	// removed before they are queried
+	exitCodes     map[string]int
+	exitCodesLock sync.Mutex
 }
 
-var dockerNetworkName = "spark-network"
+type DockerConfig struct {
+	// Host is the address of the docker daemon (i.e. tcp://10.0.0.1:2376).
+	// If empty, it is resolved from the DOCKER_HOST environment variable.
+	Host string `json:"host,omitempty"`
+
+	// CertPath is the directory with the TLS certificates (ca.pem, cert.pem
+	// and key.pem) to connect to the docker daemon.
+	CertPath string `json:"certPath,omitempty"`
+
+	// AlwaysPull pulls the images of the tasks even if they are present
+	// locally. Each image is pulled once per run.
+	AlwaysPull bool `json:"alwaysPull,omitempty"`
+
+	// AutoRemove removes the containers once they exit. Their logs are
+	// captured while they run so they can still be gathered.
+	AutoRemove bool `json:"autoRemove,omitempty"`
+
+	// NetworkName is the network shared by the containers. It is created
+	// if it does not exist (default: spark-network).
+	NetworkName string `json:"networkName,omitempty"`
+
+	// ExternalNetwork uses a network managed by the user. It must exist
+	// and it is never created.
+	ExternalNetwork bool `json:"externalNetwork,omitempty"`
+
+	// RegistryUsername and RegistryPassword are the credentials to pull
+	// images from a private registry
+	RegistryUsername string `json:"registryUsername,omitempty"`
+	RegistryPassword string `json:"registryPassword,omitempty"`
+
+	// RegistryAuth is the base64 encoded auth config of the registry. It
+	// takes precedence over RegistryUsername and RegistryPassword.
+	RegistryAuth string `json:"registryAuth,omitempty"`
+
+	// ReadyTimeout is the maximum time to wait for a container to be healthy
+	// (or running if the image has no healthcheck).
+	ReadyTimeout time.Duration `json:"readyTimeout,omitempty"`
+}
+
+// dockerTaskLogs are the logs of a container
+type dockerTaskLogs struct {
+	combined, stdout, stderr logBuffer
+
+	// doneCh is closed once all the logs are read
+	doneCh chan struct{}
+}
+
+func newDockerTaskLogs() *dockerTaskLogs {
+	return &dockerTaskLogs{doneCh: make(chan struct{})}
+}
+
+// copyFrom demuxes the docker log stream into the buffers
+func (l *dockerTaskLogs) copyFrom(reader io.Reader) error {
+	defer close(l.doneCh)
+
+	_, err := stdcopy.StdCopy(io.MultiWriter(&l.stdout, &l.combined), io.MultiWriter(&l.stderr, &l.combined), reader)
+	return err
+}
+
+// logBuffer is a bytes.Buffer safe for concurrent use
+type logBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+var defaultDockerNetworkName = "spark-network"
+
+var defaultDockerReadyTimeout = 1 * time.Minute
+
+// dockerStopTimeout is the time to stop a container once its context is cancelled
+var dockerStopTimeout = 30 * time.Second
+
+// dockerExitErrorLines is the number of lines of stderr in the error of
+// a failed container
+var dockerExitErrorLines = 10
+
+// dockerMinMemory is the minimum memory limit (6MiB) accepted by docker
+var dockerMinMemory int64 = 6 * 1024 * 1024
 
 var _ provider = &dockerProvider{}
+var _ taskRemover = &dockerProvider{}
+var _ stdLogsGetter = &dockerProvider{}
+var _ logStreamer = &dockerProvider{}
 
-func newDockerProvider() (*dockerProvider, error) {
-	cli, err := client.NewClientWithOpts(client.FromEnv)
+func newDockerProvider(config *DockerConfig) (*dockerProvider, error) {
+	opts := []client.Opt{client.FromEnv}
+	if config.Host != "" {
+		opts = append(opts, client.WithHost(config.Host))
+	}
+	if config.CertPath != "" {
+		opts = append(opts, client.WithTLSClientConfig(
+			filepath.Join(config.CertPath, "ca.pem"),
+			filepath.Join(config.CertPath, "cert.pem"),
+			filepath.Join(config.CertPath, "key.pem"),
+		))
+	}
+
+	cli, err := client.NewClientWithOpts(opts...)
 	if err != nil {
 		return nil, err
 	}
 	cli.NegotiateAPIVersion(context.Background())
 
 	p := &dockerProvider{
-		logger: slog.With("dockerProvider"),
-		cli:    cli,
+		logger:       slog.With("provider", "docker"),
+		config:       config,
+		cli:          cli,
+		pulledImages: map[string]struct{}{},
+		logs:         map[string]*dockerTaskLogs{},
+		exitCodes:    map[string]int{},
 	}
 
-	// create a network if there is none yet
-	if _, err := cli.NetworkInspect(context.Background(), dockerNetworkName, types.NetworkInspectOptions{}); err != nil {
-		slog.Info("creating network", "name", dockerNetworkName)
-		if _, err = cli.NetworkCreate(context.Background(), dockerNetworkName, types.NetworkCreate{}); err != nil {
-			return nil, err
-		}
+	if err := p.setupNetwork(); err != nil {
+		return nil, err
 	}
 	return p, nil
 }
 
-func (d *dockerProvider) GetLogs(handle *taskHandle) (string, error) {
-	logs, err := d.cli.ContainerLogs(context.Background(), handle.Id, container.LogsOptions{ShowStdout: true, ShowStderr: true})
+func (d *dockerProvider) networkName() string {
+	if d.config.NetworkName == "" {
+		return defaultDockerNetworkName
+	}
+	return d.config.NetworkName
+}
+
+// setupNetwork checks that the network can be used by the containers and
+// creates it if there is none yet
+func (d *dockerProvider) setupNetwork() error {
+	name := d.networkName()
+
+	res, err := d.cli.NetworkInspect(context.Background(), name, types.NetworkInspectOptions{})
 	if err != nil {
-		return "", err
+		if !client.IsErrNotFound(err) {
+			return err
+		}
+		if d.config.ExternalNetwork {
+			return fmt.Errorf("docker network '%s' not found", name)
+		}
+
+		d.logger.Info("creating network", "name", name)
+		if _, err = d.cli.NetworkCreate(context.Background(), name, types.NetworkCreate{Driver: "bridge"}); err != nil {
+			return err
+		}
+		return nil
 	}
-	defer logs.Close()
 
-	var buf bytes.Buffer
-	if _, err = stdcopy.StdCopy(&buf, &buf, logs); err != nil {
+	// the containers are attached to the network when they are created
+	if res.Driver != "bridge" && !(res.Driver == "overlay" && res.Attachable) {
+		return fmt.Errorf("docker network '%s' has driver '%s', expected a bridge or an attachable overlay network", name, res.Driver)
+	}
+	return nil
+}
+
+// readLogs reads the current logs of the container
+func (d *dockerProvider) readLogs(ctx context.Context, id string) (*dockerTaskLogs, error) {
+	reader, err := d.cli.ContainerLogs(ctx, id, container.LogsOptions{ShowStdout: true, ShowStderr: true})
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	logs := newDockerTaskLogs()
+	if err := logs.copyFrom(reader); err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+// taskLogs returns the logs kept in memory of the task or the current
+// logs of its container
+func (d *dockerProvider) taskLogs(ctx context.Context, handle *taskHandle) (*dockerTaskLogs, error) {
+	d.logsLock.Lock()
+	logs, ok := d.logs[handle.Id]
+	d.logsLock.Unlock()
+
+	if ok {
+		return logs, nil
+	}
+	return d.readLogs(ctx, handle.Id)
+}
+
+func (d *dockerProvider) GetLogs(ctx context.Context, handle *taskHandle) (string, error) {
+	logs, err := d.taskLogs(ctx, handle)
+	if err != nil {
 		return "", err
 	}
+	return logs.combined.String(), nil
+}
 
-	return buf.String(), nil
+// GetStdLogs returns the stdout and stderr of the container demuxed
+func (d *dockerProvider) GetStdLogs(ctx context.Context, handle *taskHandle) (string, string, error) {
+	logs, err := d.taskLogs(ctx, handle)
+	if err != nil {
+		return "", "", err
+	}
+	return logs.stdout.String(), logs.stderr.String(), nil
+}
+
+// StreamLogs follows the logs of the container until it exits
+func (d *dockerProvider) StreamLogs(ctx context.Context, handle *taskHandle, w io.Writer) error {
+	reader, err := d.cli.ContainerLogs(ctx, handle.Id, container.LogsOptions{ShowStdout: true, ShowStderr: true, Follow: true})
+	if err != nil {
+		if !client.IsErrNotFound(err) {
+			return err
+		}
+
+		// the container is already removed, write the logs kept in memory
+		d.logsLock.Lock()
+		logs, ok := d.logs[handle.Id]
+		d.logsLock.Unlock()
+
+		if !ok {
+			return err
+		}
+		_, err = io.WriteString(w, logs.combined.String())
+		return err
+	}
+	defer reader.Close()
+
+	// the stream ends when the container exits. StdCopy only writes
+	// complete frames and it drops a partial one if the stream is cut.
+	if _, err := stdcopy.StdCopy(w, w, reader); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return ctx.Err()
 }
 
-func (d *dockerProvider) WaitForTask(handle *taskHandle) error {
-	waitCh, errCh := d.cli.ContainerWait(context.Background(), handle.Id, container.WaitConditionNotRunning)
+func (d *dockerProvider) WaitForTask(ctx context.Context, handle *taskHandle) error {
+	// the container might be gone once it is not running if it is auto removed
+	condition := container.WaitConditionNotRunning
+	if d.config.AutoRemove {
+		condition = container.WaitConditionRemoved
+	}
+	waitCh, errCh := d.cli.ContainerWait(ctx, handle.Id, condition)
 
+	var res container.WaitResponse
 	select {
 	case err := <-errCh:
+		if ctx.Err() == nil {
+			return err
+		}
+
+		// do not leave the container running if the wait is cancelled
+		d.logger.Info("wait cancelled, stopping container", "id", handle.ShortId)
+
+		stopCtx, cancel := context.WithTimeout(context.Background(), dockerStopTimeout)
+		defer cancel()
+
+		if err := d.cli.ContainerStop(stopCtx, handle.Id, container.StopOptions{}); err != nil && !client.IsErrNotFound(err) {
+			d.logger.Error("failed to stop container", "id", handle.ShortId, "err", err)
+		}
+		return ctx.Err()
+	case res = <-waitCh:
+	}
+	traceStatus(ctx, "exited")
+
+	if res.Error == nil {
+		d.exitCodesLock.Lock()
+		d.exitCodes[handle.Id] = int(res.StatusCode)
+		d.exitCodesLock.Unlock()
+	}
+
+	d.stopSidecars(ctx, handle)
+
+	// wait for the captured logs to be complete
+	d.logsLock.Lock()
+	logs, ok := d.logs[handle.Id]
+	d.logsLock.Unlock()
+
+	if ok {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-logs.doneCh:
+		}
+	}
+
+	if res.Error != nil {
+		return fmt.Errorf("container %s failed: %s", handle.ShortId, res.Error.Message)
+	}
+	if res.StatusCode != 0 {
+		msg := fmt.Sprintf("container %s exited with code %d", handle.ShortId, res.StatusCode)
+		if logs, err := d.taskLogs(ctx, handle); err == nil {
+			if stderr := lastLines(logs.stderr.String(), dockerExitErrorLines); stderr != "" {
+				msg += ":\n" + stderr
+			}
+		}
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// lastLines returns the last n lines of the text
+func lastLines(text string, n int) string {
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// registryAuth returns the encoded credentials of the registry
+func (d *dockerProvider) registryAuth() (string, error) {
+	if d.config.RegistryAuth != "" {
+		return d.config.RegistryAuth, nil
+	}
+	if d.config.RegistryUsername == "" {
+		return "", nil
+	}
+	return registry.EncodeAuthConfig(registry.AuthConfig{
+		Username: d.config.RegistryUsername,
+		Password: d.config.RegistryPassword,
+	})
+}
+
+// pullImage pulls the image unless it is already present locally or
+// it was pulled before in this run.
+func (d *dockerProvider) pullImage(ctx context.Context, image string) (err error) {
+	ctx, span := tracer.Start(ctx, "pullImage", trace.WithAttributes(attribute.String("image", image)))
+	defer func() { endSpan(span, err) }()
+
+	d.pulledImagesLock.Lock()
+	defer d.pulledImagesLock.Unlock()
+
+	if _, ok := d.pulledImages[image]; ok {
+		return nil
+	}
+	if !d.config.AlwaysPull {
+		_, _, err := d.cli.ImageInspectWithRaw(ctx, image)
+		if err == nil {
+			d.pulledImages[image] = struct{}{}
+			return nil
+		}
+		if !client.IsErrNotFound(err) {
+			return err
+		}
+	}
+
+	d.logger.Info("pulling image", "image", image)
+
+	registryAuth, err := d.registryAuth()
+	if err != nil {
 		return err
-	case <-waitCh:
 	}
+	reader, err := d.cli.ImagePull(ctx, image, types.ImagePullOptions{RegistryAuth: registryAuth})
+	if err != nil {
+		return fmt.Errorf("failed to pull image %s: %w", image, err)
+	}
+	defer reader.Close()
+
+	// the pull is done once the progress stream is drained
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return fmt.Errorf("failed to pull image %s: %w", image, err)
+	}
+	traceStatus(ctx, "pulled")
+
+	d.pulledImages[image] = struct{}{}
 	return nil
 }
 
-func (d *dockerProvider) CreateTask(task *Task) (*taskHandle, error) {
+func (d *dockerProvider) CreateTask(ctx context.Context, task *Task) (*taskHandle, error) {
+	logger := taskLogger(d.logger, task)
+
+	if err := d.pullImage(ctx, task.Image); err != nil {
+		return nil, err
+	}
+
 	config := &container.Config{
-		Image: task.Image,
-		Cmd:   strslice.StrSlice(task.Args),
+		Image:  task.Image,
+		Cmd:    strslice.StrSlice(task.Args),
+		User:   task.User,
+		Labels: dockerLabels(task.Labels),
 	}
 	for name, value := range task.Env {
 		config.Env = append(config.Env, name+"="+value)
 	}
 
+	// expose the ports of the task and publish them on ephemeral host ports,
+	// the other tasks reach them directly through the docker network.
+	portBindings := nat.PortMap{}
+	if len(task.Ports) != 0 {
+		config.ExposedPorts = nat.PortSet{}
+		for _, port := range task.Ports {
+			p := nat.Port(fmt.Sprintf("%d/tcp", port))
+			config.ExposedPorts[p] = struct{}{}
+			portBindings[p] = []nat.PortBinding{{}}
+		}
+	}
+
+	// the resources are unlimited unless the task sets them
+	if task.Memory != 0 && task.Memory < dockerMinMemory {
+		return nil, fmt.Errorf("memory of task %s is %d bytes, docker requires at least %d bytes", task.Name, task.Memory, dockerMinMemory)
+	}
+
 	hostConfig := &container.HostConfig{
-		NetworkMode: container.NetworkMode(dockerNetworkName),
+		NetworkMode:  container.NetworkMode(d.networkName()),
+		DNS:          task.DNSServers,
+		PortBindings: portBindings,
+		Resources: container.Resources{
+			NanoCPUs: task.Cpu * 1e6,
+			Memory:   task.Memory,
+		},
+		AutoRemove: d.config.AutoRemove,
+	}
+	for _, m := range task.Mounts {
+		hostConfig.Mounts = append(hostConfig.Mounts, mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   m.HostPath,
+			Target:   m.ContainerPath,
+			ReadOnly: m.ReadOnly,
+		})
+	}
+
+	// the aliases resolve to the container in the docker network
+	networkingConfig := &network.NetworkingConfig{}
+	if len(task.Aliases) != 0 {
+		networkingConfig.EndpointsConfig = map[string]*network.EndpointSettings{
+			d.networkName(): {Aliases: task.Aliases},
+		}
 	}
 
-	body, err := d.cli.ContainerCreate(context.Background(), config, hostConfig, &network.NetworkingConfig{}, nil, "")
+	body, err := d.cli.ContainerCreate(ctx, config, hostConfig, networkingConfig, nil, "")
 	if err != nil {
 		return nil, err
 	}
-	if err := d.cli.ContainerStart(context.Background(), body.ID, container.StartOptions{}); err != nil {
+	traceStatus(ctx, "created")
+
+	// the container is removed if it cannot be started
+	removeContainer := func() {
+		if err := d.cli.ContainerRemove(context.Background(), body.ID, container.RemoveOptions{Force: true}); err != nil {
+			logger.Error("failed to remove container", "id", shortContainerId(body.ID), "err", err)
+		}
+		d.logsLock.Lock()
+		delete(d.logs, body.ID)
+		d.logsLock.Unlock()
+	}
+
+	if err := d.copyFiles(ctx, body.ID, task.Files); err != nil {
+		removeContainer()
+		return nil, err
+	}
+
+	// attach before the container starts so that none of the logs are
+	// lost if it exits and it is removed
+	if d.config.AutoRemove {
+		if err := d.captureLogs(body.ID); err != nil {
+			removeContainer()
+			return nil, err
+		}
+	}
+
+	if err := d.cli.ContainerStart(ctx, body.ID, container.StartOptions{}); err != nil {
+		removeContainer()
 		return nil, err
 	}
 
 	handle := &taskHandle{
-		Id: body.ID,
+		Id:      body.ID,
+		ShortId: shortContainerId(body.ID),
 	}
+
+	err = d.waitForReady(ctx, handle)
+	if err == nil {
+		err = d.createSidecars(ctx, handle, task)
+	}
+	if err != nil {
+		if err := d.RemoveTask(context.Background(), handle); err != nil {
+			logger.Error("failed to remove container", "id", handle.ShortId, "err", err)
+		}
+		return nil, err
+	}
+	traceStatus(ctx, "running")
+	logger.Info("container is running", "id", handle.ShortId)
+
+	handle.StartedAt = time.Now()
 	return handle, nil
 }
+
+// copyFiles writes the files in the container before it starts
+func (d *dockerProvider) copyFiles(ctx context.Context, id string, files []File) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, file := range files {
+		hdr := &tar.Header{
+			Name: strings.TrimPrefix(file.Path, "/"),
+			Mode: 0644,
+			Size: int64(len(file.Content)),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(file.Content); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	if err := d.cli.CopyToContainer(ctx, id, "/", &buf, types.CopyToContainerOptions{}); err != nil {
+		return fmt.Errorf("failed to copy the files to container %s: %w", shortContainerId(id), err)
+	}
+	return nil
+}
+
+// waitForReady waits until the container is healthy if the image defines a
+// healthcheck, or until it is running otherwise. A container that already
+// exited is ready, WaitForTask reports how it exited.
+func (d *dockerProvider) waitForReady(ctx context.Context, handle *taskHandle) (err error) {
+	ctx, span := tracer.Start(ctx, "waitForReady", trace.WithAttributes(attribute.String("task.id", handle.Id)))
+	defer func() { endSpan(span, err) }()
+
+	timeout := d.config.ReadyTimeout
+	if timeout == 0 {
+		timeout = defaultDockerReadyTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		res, err := d.cli.ContainerInspect(ctx, handle.Id)
+		if err != nil && client.IsErrNotFound(err) {
+			// it exited and it was auto removed
+			return nil
+		}
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+
+		if err == nil {
+			state := res.State
+			if state.Health != nil {
+				switch state.Health.Status {
+				case types.Healthy:
+					return nil
+				case types.Unhealthy:
+					return fmt.Errorf("container %s is unhealthy", handle.ShortId)
+				}
+			} else if state.Running {
+				return nil
+			}
+			if state.Status == "exited" || state.Status == "dead" {
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("container %s not ready after %s", handle.ShortId, timeout)
+			}
+			return ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// TaskStatus maps the state of the container to the phase of the task
+func (d *dockerProvider) TaskStatus(ctx context.Context, handle *taskHandle) (TaskPhase, error) {
+	res, err := d.cli.ContainerInspect(ctx, handle.Id)
+	if err != nil {
+		return "", err
+	}
+
+	switch res.State.Status {
+	case "created":
+		return TaskPending, nil
+	case "exited", "dead":
+		if res.State.ExitCode == 0 {
+			return TaskSucceeded, nil
+		}
+		return TaskFailed, nil
+	default:
+		// running, paused, restarting and removing
+		return TaskRunning, nil
+	}
+}
+
+// Ping checks that the docker daemon is reachable
+func (d *dockerProvider) Ping(ctx context.Context) error {
+	_, err := d.cli.Ping(ctx)
+	return err
+}
+
+// ExitCode returns the exit code of the container once it has exited
+func (d *dockerProvider) ExitCode(ctx context.Context, handle *taskHandle) (int, bool, error) {
+	d.exitCodesLock.Lock()
+	code, ok := d.exitCodes[handle.Id]
+	d.exitCodesLock.Unlock()
+	if ok {
+		return code, true, nil
+	}
+
+	res, err := d.cli.ContainerInspect(ctx, handle.Id)
+	if err != nil {
+		return 0, false, err
+	}
+	if res.State.Status != "exited" && res.State.Status != "dead" {
+		return 0, false, nil
+	}
+	return res.State.ExitCode, true, nil
+}
+
+// shortContainerId returns the 12 characters id used by the docker cli
+func shortContainerId(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// createSidecars starts the sidecars of the task in the network namespace
+// of its main container
+func (d *dockerProvider) createSidecars(ctx context.Context, handle *taskHandle, task *Task) error {
+	for _, sidecar := range task.Sidecars {
+		if err := d.pullImage(ctx, sidecar.Image); err != nil {
+			return err
+		}
+
+		config := &container.Config{
+			Image:  sidecar.Image,
+			Cmd:    strslice.StrSlice(sidecar.Args),
+			User:   task.User,
+			Labels: dockerLabels(task.Labels),
+		}
+		if len(sidecar.Command) != 0 {
+			config.Entrypoint = strslice.StrSlice(sidecar.Command)
+		}
+		for name, value := range sidecar.Env {
+			config.Env = append(config.Env, name+"="+value)
+		}
+
+		hostConfig := &container.HostConfig{
+			NetworkMode: container.NetworkMode("container:" + handle.Id),
+			AutoRemove:  d.config.AutoRemove,
+		}
+
+		body, err := d.cli.ContainerCreate(ctx, config, hostConfig, &network.NetworkingConfig{}, nil, "")
+		if err != nil {
+			return fmt.Errorf("failed to create sidecar %s: %w", sidecar.Name, err)
+		}
+		handle.SidecarIds = append(handle.SidecarIds, body.ID)
+
+		if err := d.cli.ContainerStart(ctx, body.ID, container.StartOptions{}); err != nil {
+			return fmt.Errorf("failed to start sidecar %s: %w", sidecar.Name, err)
+		}
+	}
+	return nil
+}
+
+// stopSidecars stops the sidecars once the main container is done
+func (d *dockerProvider) stopSidecars(ctx context.Context, handle *taskHandle) {
+	for _, id := range handle.SidecarIds {
+		if err := d.cli.ContainerStop(ctx, id, container.StopOptions{}); err != nil && !client.IsErrNotFound(err) {
+			d.logger.Error("failed to stop sidecar", "id", shortContainerId(id), "err", err)
+		}
+	}
+}
+
+// captureLogs attaches to the output of the container and keeps its
+// logs in memory
+func (d *dockerProvider) captureLogs(id string) error {
+	resp, err := d.cli.ContainerAttach(context.Background(), id, container.AttachOptions{Stream: true, Stdout: true, Stderr: true})
+	if err != nil {
+		return err
+	}
+
+	logs := newDockerTaskLogs()
+	d.logsLock.Lock()
+	d.logs[id] = logs
+	d.logsLock.Unlock()
+
+	go func() {
+		defer resp.Close()
+		if err := logs.copyFrom(resp.Reader); err != nil {
+			d.logger.Warn("failed to capture the container logs", "id", shortContainerId(id), "err", err)
+		}
+	}()
+	return nil
+}
+
+// StopTask stops and removes the container. Its logs are kept in memory
+// to be gathered later. The container may already be removed by docker if
+// AutoRemove is set.
+func (d *dockerProvider) StopTask(ctx context.Context, handle *taskHandle) error {
+	if err := d.cli.ContainerStop(ctx, handle.Id, container.StopOptions{}); err != nil && !client.IsErrNotFound(err) {
+		return err
+	}
+	d.stopSidecars(ctx, handle)
+
+	if d.config.AutoRemove {
+		// docker removes it and its logs are already captured
+		return nil
+	}
+	return d.RemoveTask(ctx, handle)
+}
+
+// RemoveTask removes the container after it keeps its logs in memory
+func (d *dockerProvider) RemoveTask(ctx context.Context, handle *taskHandle) error {
+	for _, id := range handle.SidecarIds {
+		if err := d.cli.ContainerRemove(ctx, id, container.RemoveOptions{Force: true}); err != nil && !client.IsErrNotFound(err) {
+			return err
+		}
+	}
+
+	d.logsLock.Lock()
+	_, ok := d.logs[handle.Id]
+	d.logsLock.Unlock()
+
+	if !ok {
+		logs, err := d.readLogs(ctx, handle.Id)
+		if err != nil {
+			if client.IsErrNotFound(err) {
+				return nil
+			}
+			return err
+		}
+		d.logsLock.Lock()
+		d.logs[handle.Id] = logs
+		d.logsLock.Unlock()
+	}
+
+	if err := d.cli.ContainerRemove(ctx, handle.Id, container.RemoveOptions{Force: true}); err != nil && !client.IsErrNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// dockerLabelManaged is set on every container of sparkanywhere so that
+// they can be found with docker ps --filter label=sparkanywhere
+const dockerLabelManaged = "sparkanywhere"
+
+// dockerLabels returns the labels of the task and the sparkanywhere label
+func dockerLabels(labels map[string]string) map[string]string {
+	res := make(map[string]string, len(labels)+1)
+	for key, value := range labels {
+		res[key] = value
+	}
+	res[dockerLabelManaged] = "true"
+	return res
+}
+
+// ListManagedContainers returns the containers (running or not) launched by
+// sparkanywhere on any run, including the current one
+func (d *dockerProvider) ListManagedContainers(ctx context.Context) ([]types.Container, error) {
+	return d.cli.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", dockerLabelManaged)),
+	})
+}
+
+// ListOrphanedTasks returns the managed containers of a different run than
+// the current one (i.e. leftovers from a crashed run).
+func (d *dockerProvider) ListOrphanedTasks(ctx context.Context, currentRunId string) ([]*taskHandle, error) {
+	containers, err := d.ListManagedContainers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	handles := []*taskHandle{}
+	for _, c := range containers {
+		if c.Labels[labelRunId] == currentRunId {
+			continue
+		}
+		handles = append(handles, &taskHandle{
+			Name:    c.Labels[labelPodName],
+			Id:      c.ID,
+			ShortId: shortContainerId(c.ID),
+		})
+	}
+	return handles, nil
+}
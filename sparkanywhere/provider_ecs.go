@@ -1,55 +1,225 @@
 package sparkanywhere
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"log/slog"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ecsProvider struct {
 	log *slog.Logger
 
-	config *ECSConfig
-	svc    *ecs.ECS
+	config  *ECSConfig
+	svc     *ecs.ECS
+	logsSvc *cloudwatchlogs.CloudWatchLogs
 
 	// taskDefinitionName is the full name for the task definition with the revision
 	taskDefinitionName string
 
 	// taskDefinitionContainerName is the name of apache/spark container of the task definition
 	taskDefinitionContainerName string
+
+	// taskDefinitionSidecarNames are the names of the other containers of the
+	// task definition, the sidecars of the tasks must be one of them
+	taskDefinitionSidecarNames map[string]struct{}
+
+	// subnets are the subnets where the tasks are placed
+	subnets []string
+
+	// taskDefinitionContainerResources is true if the container in the task
+	// definition sets its own cpu or memory
+	taskDefinitionContainerResources bool
+
+	// taskDefinitionDNSServers are the DNS servers of the container in the task definition
+	taskDefinitionDNSServers []string
+
+	dnsWarningOnce            sync.Once
+	mountsWarningOnce         sync.Once
+	filesWarningOnce          sync.Once
+	aliasesWarningOnce        sync.Once
+	sidecarCommandWarningOnce sync.Once
+
+	// taskDefinitionContainerUser is the user of the container in the task definition.
+	// ECS cannot override it when running the task.
+	taskDefinitionContainerUser string
+
+	// taskDefinitionLogGroup and taskDefinitionLogStreamPrefix are the CloudWatch
+	// settings of the container if it uses the awslogs log driver
+	taskDefinitionLogGroup        string
+	taskDefinitionLogStreamPrefix string
+
+	// poller describes the tasks that are waited for in a single call
+	poller *ecsTaskPoller
 }
 
 type ECSConfig struct {
-	ClusterName   string
-	SubnetId      string
-	SecurityGroup string
+	ClusterName string `json:"clusterName,omitempty"`
+
+	// Region is the AWS region of the cluster. If empty, it is resolved
+	// from the AWS_REGION environment variable.
+	Region string `json:"region,omitempty"`
+
+	// SubnetId is a comma separated list of subnets. It is merged with SubnetIds.
+	SubnetId string `json:"subnetId,omitempty"`
+
+	// SubnetIds are the subnets to spread the tasks across.
+	SubnetIds []string `json:"subnetIds,omitempty"`
+
+	SecurityGroup string `json:"securityGroup,omitempty"`
+
+	// AssignPublicIp assigns a public ip to the tasks (default: true). If
+	// disabled, the subnets still need a route (i.e. NAT gateway or VPC
+	// endpoints) to pull the image and to reach the control plane.
+	AssignPublicIp *bool `json:"assignPublicIp,omitempty"`
+
+	// CapacityProvider is the capacity provider used to launch the tasks
+	// (i.e. FARGATE or FARGATE_SPOT). If empty, tasks are launched with
+	// the FARGATE launch type.
+	CapacityProvider string `json:"capacityProvider,omitempty"`
+
+	// TaskDefinitionFamily is the task definition family used to run the
+	// tasks. If empty, it looks for the only family that contains 'sparkanywhere'.
+	TaskDefinitionFamily string `json:"taskDefinitionFamily,omitempty"`
+
+	// TaskDefinitionRevision pins the revision of the task definition.
+	// If zero, the latest revision of the family is used.
+	TaskDefinitionRevision int `json:"taskDefinitionRevision,omitempty"`
+
+	// RoleArn is the IAM role assumed to run the tasks (i.e. in a different
+	// account). If empty, it uses the shared credentials.
+	RoleArn string `json:"roleArn,omitempty"`
+
+	// MaxAttempts is the number of times a throttled or failed (5xx) ECS API
+	// call is attempted before giving up. Defaults to 5.
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+
+	// CreateTimeout bounds how long CreateTask waits for the task to be
+	// RUNNING before it stops it. Zero means no timeout.
+	CreateTimeout time.Duration `json:"createTimeout,omitempty"`
+
+	// PollInitialInterval and PollMaxInterval bound the backoff between the
+	// checks of the status of the tasks. Default to 1s and 10s.
+	PollInitialInterval time.Duration `json:"pollInitialInterval,omitempty"`
+	PollMaxInterval     time.Duration `json:"pollMaxInterval,omitempty"`
+}
+
+// subnets returns the deduplicated list of subnets from SubnetId and SubnetIds
+func (e *ECSConfig) subnets() []string {
+	subnets := []string{}
+	seen := map[string]struct{}{}
+
+	for _, subnet := range append(strings.Split(e.SubnetId, ","), e.SubnetIds...) {
+		subnet = strings.TrimSpace(subnet)
+		if subnet == "" {
+			continue
+		}
+		if _, ok := seen[subnet]; ok {
+			continue
+		}
+		seen[subnet] = struct{}{}
+		subnets = append(subnets, subnet)
+	}
+	return subnets
+}
+
+// assignPublicIp returns whether the tasks get a public ip, nil means true
+func (e *ECSConfig) assignPublicIp() bool {
+	return e.AssignPublicIp == nil || *e.AssignPublicIp
+}
+
+// validate checks the required fields of the config and reports all the
+// problems at once
+func (e *ECSConfig) validate() error {
+	problems := []string{}
+	if e.ClusterName == "" {
+		problems = append(problems, "the cluster name is required")
+	}
+	if len(e.subnets()) == 0 {
+		problems = append(problems, "at least one subnet is required")
+	}
+	if e.SecurityGroup == "" {
+		problems = append(problems, "the security group is required")
+	}
+	if e.Region == "" && os.Getenv("AWS_REGION") == "" {
+		problems = append(problems, "the region is required (or the AWS_REGION environment variable)")
+	}
+	if len(problems) != 0 {
+		return fmt.Errorf("invalid ECS config: %s", strings.Join(problems, ", "))
+	}
+	return nil
 }
 
 func newEcsProvider(config *ECSConfig) (provider, error) {
-	sess, err := session.NewSession(&aws.Config{
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	awsConfig := &aws.Config{
 		Credentials: credentials.NewSharedCredentials("", ""),
-	})
+	}
+	if config.Region != "" {
+		awsConfig.Region = aws.String(config.Region)
+	}
+	sess, err := session.NewSession(awsConfig)
 	if err != nil {
 		return nil, err
 	}
+	if aws.StringValue(sess.Config.Region) == "" {
+		return nil, fmt.Errorf("AWS region not found, set it with the ECS region or the AWS_REGION environment variable")
+	}
+	if config.RoleArn != "" {
+		sess = sess.Copy(&aws.Config{
+			Credentials: stscreds.NewCredentials(sess, config.RoleArn),
+		})
+	}
 	svc := ecs.New(sess)
 
 	p := &ecsProvider{
-		log:    slog.With("provider", "ecs"),
-		config: config,
-		svc:    svc,
+		log:     slog.With("provider", "ecs"),
+		config:  config,
+		svc:     svc,
+		logsSvc: cloudwatchlogs.New(sess),
+	}
+	pollInitialInterval, pollMaxInterval := config.PollInitialInterval, config.PollMaxInterval
+	if pollInitialInterval <= 0 {
+		pollInitialInterval = defaultEcsPollInitialInterval
+	}
+	if pollMaxInterval <= 0 {
+		pollMaxInterval = defaultEcsPollMaxInterval
 	}
+	if pollMaxInterval < pollInitialInterval {
+		pollMaxInterval = pollInitialInterval
+	}
+	p.poller = newEcsTaskPoller(pollInitialInterval, pollMaxInterval, p.describeTasks)
 
 	// query the cluster name and figure out the task definition, revision and container name.
-	output, err := svc.DescribeClusters(&ecs.DescribeClustersInput{Clusters: []*string{aws.String(config.ClusterName)}})
+	var output *ecs.DescribeClustersOutput
+	err = retryEcs(context.Background(), config.MaxAttempts, func() (err error) {
+		output, err = svc.DescribeClusters(&ecs.DescribeClustersInput{Clusters: []*string{aws.String(config.ClusterName)}})
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -57,32 +227,57 @@ func newEcsProvider(config *ECSConfig) (provider, error) {
 		return nil, fmt.Errorf("cluster not found: %s", config.ClusterName)
 	}
 
-	taskDefs, err := svc.ListTaskDefinitionFamilies(&ecs.ListTaskDefinitionFamiliesInput{})
-	if err != nil {
-		return nil, err
+	// check that the capacity provider is attached to the cluster
+	if config.CapacityProvider != "" {
+		found := false
+		for _, name := range output.Clusters[0].CapacityProviders {
+			if aws.StringValue(name) == config.CapacityProvider {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("capacity provider %s not attached to cluster %s", config.CapacityProvider, config.ClusterName)
+		}
 	}
 
-	sparkAnywhereTaskDefs := []string{}
-	for _, x := range taskDefs.Families {
-		if strings.Contains(*x, "sparkanywhere") {
-			sparkAnywhereTaskDefs = append(sparkAnywhereTaskDefs, *x)
+	taskDef := config.TaskDefinitionFamily
+	if taskDef == "" {
+		if taskDef, err = discoverTaskDefinitionFamily(svc); err != nil {
+			return nil, err
 		}
 	}
-	if len(sparkAnywhereTaskDefs) == 0 {
-		return nil, fmt.Errorf("no task definition found")
-	}
-	if len(sparkAnywhereTaskDefs) > 1 {
-		return nil, fmt.Errorf("more than one task definition found")
-	}
 
-	taskDef := sparkAnywhereTaskDefs[0]
+	if config.TaskDefinitionRevision > 0 {
+		taskDef = fmt.Sprintf("%s:%d", taskDef, config.TaskDefinitionRevision)
+	}
 	out2, err := svc.DescribeTaskDefinition(&ecs.DescribeTaskDefinitionInput{TaskDefinition: aws.String(taskDef)})
 	if err != nil {
+		return nil, fmt.Errorf("failed to describe task definition %s: %w", taskDef, err)
+	}
+
+	if err := validateTaskDefinition(out2.TaskDefinition); err != nil {
 		return nil, err
 	}
 
-	p.taskDefinitionName = fmt.Sprintf("%s:%d", taskDef, *out2.TaskDefinition.Revision)
+	p.taskDefinitionName = fmt.Sprintf("%s:%d", *out2.TaskDefinition.Family, *out2.TaskDefinition.Revision)
 	p.taskDefinitionContainerName = *out2.TaskDefinition.ContainerDefinitions[0].Name
+	p.taskDefinitionSidecarNames = map[string]struct{}{}
+	for _, containerDef := range out2.TaskDefinition.ContainerDefinitions[1:] {
+		p.taskDefinitionSidecarNames[aws.StringValue(containerDef.Name)] = struct{}{}
+	}
+	p.taskDefinitionContainerUser = aws.StringValue(out2.TaskDefinition.ContainerDefinitions[0].User)
+	p.taskDefinitionContainerResources = aws.Int64Value(out2.TaskDefinition.ContainerDefinitions[0].Cpu) != 0 || aws.Int64Value(out2.TaskDefinition.ContainerDefinitions[0].Memory) != 0
+	p.taskDefinitionDNSServers = aws.StringValueSlice(out2.TaskDefinition.ContainerDefinitions[0].DnsServers)
+
+	if logConfig := out2.TaskDefinition.ContainerDefinitions[0].LogConfiguration; logConfig != nil && aws.StringValue(logConfig.LogDriver) == ecs.LogDriverAwslogs {
+		p.taskDefinitionLogGroup = aws.StringValue(logConfig.Options["awslogs-group"])
+		p.taskDefinitionLogStreamPrefix = aws.StringValue(logConfig.Options["awslogs-stream-prefix"])
+	}
+
+	if err := validateEcrPull(iam.New(sess), out2.TaskDefinition); err != nil {
+		return nil, err
+	}
 
 	p.log.Info("Using task definitione", "name", p.taskDefinitionName)
 	p.log.Info("Detected task primary container", "name", p.taskDefinitionContainerName)
@@ -90,9 +285,12 @@ func newEcsProvider(config *ECSConfig) (provider, error) {
 	// describe the VPN and get the subnet ids and security group.
 	svcEc2 := ec2.New(sess)
 
-	// check that the subnet exists
-	if _, err = svcEc2.DescribeSubnets(&ec2.DescribeSubnetsInput{SubnetIds: []*string{aws.String(config.SubnetId)}}); err != nil {
-		return nil, fmt.Errorf("subnet not found: %s", config.SubnetId)
+	// check that the subnets exist
+	p.subnets = config.subnets()
+	for _, subnet := range p.subnets {
+		if _, err = svcEc2.DescribeSubnets(&ec2.DescribeSubnetsInput{SubnetIds: []*string{aws.String(subnet)}}); err != nil {
+			return nil, fmt.Errorf("subnet not found: %s", subnet)
+		}
 	}
 
 	// check that the security group exists
@@ -103,8 +301,159 @@ func newEcsProvider(config *ECSConfig) (provider, error) {
 	return p, nil
 }
 
-func (e *ecsProvider) CreateTask(task *Task) (*taskHandle, error) {
-	e.log.Info("Creating task", "task", task.Name)
+// validateDNSServers warns if the DNS servers of the task cannot be honored.
+// ECS does not allow to override the DNS servers when running a task and
+// awsvpc tasks do not support them in the task definition either, they can
+// only be set in the DHCP options set of the VPC.
+func (e *ecsProvider) validateDNSServers(dnsServers []string) {
+	if strings.Join(dnsServers, ",") == strings.Join(e.taskDefinitionDNSServers, ",") {
+		return
+	}
+	e.dnsWarningOnce.Do(func() {
+		e.log.Warn("DNS servers cannot be set on awsvpc tasks, configure them in the DHCP options set of the VPC", "dns-servers", dnsServers)
+	})
+}
+
+// validateTaskDefinition checks that the task definition can run on Fargate
+// with the awsvpc network configuration used by RunTask.
+func validateTaskDefinition(taskDef *ecs.TaskDefinition) error {
+	name := fmt.Sprintf("%s:%d", aws.StringValue(taskDef.Family), aws.Int64Value(taskDef.Revision))
+
+	if networkMode := aws.StringValue(taskDef.NetworkMode); networkMode != ecs.NetworkModeAwsvpc {
+		return fmt.Errorf("task definition %s has network mode '%s', expected '%s'", name, networkMode, ecs.NetworkModeAwsvpc)
+	}
+
+	fargate := false
+	for _, compatibility := range taskDef.RequiresCompatibilities {
+		if aws.StringValue(compatibility) == ecs.CompatibilityFargate {
+			fargate = true
+		}
+	}
+	if !fargate {
+		return fmt.Errorf("task definition %s is not compatible with FARGATE (requires compatibilities: %v)", name, aws.StringValueSlice(taskDef.RequiresCompatibilities))
+	}
+	if len(taskDef.ContainerDefinitions) == 0 {
+		return fmt.Errorf("task definition %s has no container definitions", name)
+	}
+	return nil
+}
+
+// ecrImageRegexp matches the images in ECR: <account>.dkr.ecr.<region>.amazonaws.com/<repository>
+var ecrImageRegexp = regexp.MustCompile(`^(\d{12})\.dkr\.ecr\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?/([^:@]+)`)
+
+// ecrPullActions are the permissions the execution role needs to pull from ECR
+var ecrPullActions = []string{"ecr:GetAuthorizationToken", "ecr:BatchGetImage", "ecr:GetDownloadUrlForLayer"}
+
+// validateEcrPull checks that the execution role of the task definition can
+// pull its image if it is in ECR. The check is skipped (with a warning) if
+// the caller is not allowed to simulate the policies of the role.
+func validateEcrPull(svc *iam.IAM, taskDef *ecs.TaskDefinition) error {
+	image := aws.StringValue(taskDef.ContainerDefinitions[0].Image)
+
+	match := ecrImageRegexp.FindStringSubmatch(image)
+	if match == nil {
+		return nil
+	}
+	executionRole := aws.StringValue(taskDef.ExecutionRoleArn)
+	if executionRole == "" {
+		return fmt.Errorf("image %s is in ECR but the task definition has no execution role to pull it", image)
+	}
+
+	partition := "aws"
+	if strings.HasPrefix(match[2], "cn-") {
+		partition = "aws-cn"
+	}
+	repositoryArn := fmt.Sprintf("arn:%s:ecr:%s:%s:repository/%s", partition, match[2], match[1], match[3])
+
+	output, err := svc.SimulatePrincipalPolicy(&iam.SimulatePrincipalPolicyInput{
+		PolicySourceArn: aws.String(executionRole),
+		ActionNames:     aws.StringSlice(ecrPullActions),
+		ResourceArns:    aws.StringSlice([]string{repositoryArn}),
+	})
+	if err != nil {
+		slog.Warn("cannot check that the execution role can pull the image", "role", executionRole, "image", image, "err", err)
+		return nil
+	}
+
+	denied := []string{}
+	for _, result := range output.EvaluationResults {
+		if aws.StringValue(result.EvalDecision) != iam.PolicyEvaluationDecisionTypeAllowed {
+			denied = append(denied, aws.StringValue(result.EvalActionName))
+		}
+	}
+	if len(denied) != 0 {
+		return fmt.Errorf("execution role %s cannot pull image %s, it is not allowed to %s", executionRole, image, strings.Join(denied, ", "))
+	}
+	return nil
+}
+
+// fargateSizes are the valid memory (MiB) ranges for each Fargate cpu size
+var fargateSizes = []struct {
+	cpu       int64
+	minMemory int64
+	maxMemory int64
+	step      int64
+}{
+	{256, 512, 1024, 512},
+	{512, 1024, 4096, 1024},
+	{1024, 2048, 8192, 1024},
+	{2048, 4096, 16384, 1024},
+	{4096, 8192, 30720, 1024},
+	{8192, 16384, 61440, 4096},
+	{16384, 32768, 122880, 8192},
+}
+
+// fargateTaskSize returns the smallest valid Fargate cpu units and memory (MiB)
+// that fit the cpu (millicores) and memory (bytes) of the task.
+func fargateTaskSize(cpuMillis, memoryBytes int64) (int64, int64) {
+	cpuUnits := (cpuMillis*1024 + 999) / 1000
+	memoryMiB := (memoryBytes + 1024*1024 - 1) / (1024 * 1024)
+
+	for _, size := range fargateSizes {
+		if size.cpu < cpuUnits || size.maxMemory < memoryMiB {
+			continue
+		}
+		memory := size.minMemory
+		for memory < memoryMiB {
+			memory += size.step
+		}
+		return size.cpu, memory
+	}
+
+	// it does not fit, use the largest size and let ECS fail
+	largest := fargateSizes[len(fargateSizes)-1]
+	return largest.cpu, largest.maxMemory
+}
+
+// discoverTaskDefinitionFamily returns the only task definition family that contains 'sparkanywhere'
+func discoverTaskDefinitionFamily(svc *ecs.ECS) (string, error) {
+	taskDefs, err := svc.ListTaskDefinitionFamilies(&ecs.ListTaskDefinitionFamiliesInput{})
+	if err != nil {
+		return "", err
+	}
+
+	sparkAnywhereTaskDefs := []string{}
+	for _, x := range taskDefs.Families {
+		if strings.Contains(*x, "sparkanywhere") {
+			sparkAnywhereTaskDefs = append(sparkAnywhereTaskDefs, *x)
+		}
+	}
+	if len(sparkAnywhereTaskDefs) == 0 {
+		return "", fmt.Errorf("no task definition found")
+	}
+	if len(sparkAnywhereTaskDefs) > 1 {
+		return "", fmt.Errorf("more than one task definition found (%s), select one with the task definition family", strings.Join(sparkAnywhereTaskDefs, ", "))
+	}
+	return sparkAnywhereTaskDefs[0], nil
+}
+
+func (e *ecsProvider) CreateTask(ctx context.Context, task *Task) (*taskHandle, error) {
+	logger := taskLogger(e.log, task)
+	logger.Info("Creating task")
+
+	if task.User != "" && task.User != e.taskDefinitionContainerUser {
+		return nil, fmt.Errorf("task user '%s' does not match the task definition user '%s', set it in the 'user' field of the container definition", task.User, e.taskDefinitionContainerUser)
+	}
 
 	envOverride := []*ecs.KeyValuePair{}
 	for name, value := range task.Env {
@@ -113,21 +462,48 @@ func (e *ecsProvider) CreateTask(task *Task) (*taskHandle, error) {
 			Value: aws.String(value),
 		})
 	}
+	sortKeyValuePairs(envOverride)
+
+	if len(task.DNSServers) != 0 {
+		e.validateDNSServers(task.DNSServers)
+	}
+
+	// Fargate tasks cannot mount paths of the host
+	if len(task.Mounts) != 0 {
+		e.mountsWarningOnce.Do(func() {
+			logger.Warn("host path mounts are not supported on Fargate, they are ignored")
+		})
+	}
+
+	// the config maps cannot be written in the task before it starts and
+	// the services cannot be resolved in the VPC
+	if len(task.Files) != 0 {
+		e.filesWarningOnce.Do(func() {
+			logger.Warn("config map volumes are not supported on ECS, they are ignored")
+		})
+	}
+	if len(task.Aliases) != 0 {
+		e.aliasesWarningOnce.Do(func() {
+			logger.Warn("services are not resolvable on ECS, use the client deploy mode")
+		})
+	}
+
+	assignPublicIp := "DISABLED"
+	if e.config.assignPublicIp() {
+		assignPublicIp = "ENABLED"
+	}
 
 	input := &ecs.RunTaskInput{
 		Cluster:        aws.String(e.config.ClusterName),
 		TaskDefinition: aws.String(e.taskDefinitionName),
-		LaunchType:     aws.String("FARGATE"),
 		Count:          aws.Int64(1),
 		NetworkConfiguration: &ecs.NetworkConfiguration{
 			AwsvpcConfiguration: &ecs.AwsVpcConfiguration{
-				AssignPublicIp: aws.String("ENABLED"),
+				AssignPublicIp: aws.String(assignPublicIp),
 				SecurityGroups: []*string{
 					aws.String(e.config.SecurityGroup),
 				},
-				Subnets: []*string{
-					aws.String(e.config.SubnetId),
-				},
+				Subnets: aws.StringSlice(e.subnets),
 			},
 		},
 		Overrides: &ecs.TaskOverride{
@@ -141,52 +517,502 @@ func (e *ecsProvider) CreateTask(task *Task) (*taskHandle, error) {
 		},
 	}
 
-	result, err := e.svc.RunTask(input)
+	// ECS cannot add containers to a task, the sidecars must be defined in
+	// the task definition and only their command and environment are set
+	for _, sidecar := range task.Sidecars {
+		if _, ok := e.taskDefinitionSidecarNames[sidecar.Name]; !ok {
+			return nil, fmt.Errorf("sidecar %s of task %s is not a container of the task definition %s", sidecar.Name, task.Name, e.taskDefinitionName)
+		}
+
+		override := &ecs.ContainerOverride{
+			Name: aws.String(sidecar.Name),
+		}
+		// ECS cannot override the entrypoint, the command of the sidecar
+		// runs as the first arguments of the entrypoint of its image
+		if len(sidecar.Command) != 0 {
+			e.sidecarCommandWarningOnce.Do(func() {
+				logger.Warn("the entrypoint of the sidecars cannot be overridden on ECS, their command is passed as arguments", "sidecar", sidecar.Name)
+			})
+		}
+		if args := append(append([]string{}, sidecar.Command...), sidecar.Args...); len(args) != 0 {
+			override.Command = aws.StringSlice(args)
+		}
+		for name, value := range sidecar.Env {
+			override.Environment = append(override.Environment, &ecs.KeyValuePair{
+				Name:  aws.String(name),
+				Value: aws.String(value),
+			})
+		}
+		sortKeyValuePairs(override.Environment)
+		input.Overrides.ContainerOverrides = append(input.Overrides.ContainerOverrides, override)
+	}
+
+	for key, value := range task.Labels {
+		input.Tags = append(input.Tags, &ecs.Tag{
+			Key:   aws.String(key),
+			Value: aws.String(value),
+		})
+	}
+	sort.Slice(input.Tags, func(i, j int) bool {
+		return aws.StringValue(input.Tags[i].Key) < aws.StringValue(input.Tags[j].Key)
+	})
+
+	if task.Cpu != 0 || task.Memory != 0 {
+		cpu, memory := fargateTaskSize(task.Cpu, task.Memory)
+		input.Overrides.Cpu = aws.String(strconv.FormatInt(cpu, 10))
+		input.Overrides.Memory = aws.String(strconv.FormatInt(memory, 10))
+
+		// the container limits of the task definition would cap the new task size
+		if e.taskDefinitionContainerResources {
+			input.Overrides.ContainerOverrides[0].Cpu = aws.Int64(cpu)
+			input.Overrides.ContainerOverrides[0].Memory = aws.Int64(memory)
+		}
+	}
+
+	if e.config.CapacityProvider != "" {
+		input.CapacityProviderStrategy = []*ecs.CapacityProviderStrategyItem{
+			{
+				CapacityProvider: aws.String(e.config.CapacityProvider),
+				Weight:           aws.Int64(1),
+			},
+		}
+	} else {
+		input.LaunchType = aws.String("FARGATE")
+	}
+
+	// a RunTask call with a higher Count runs the tasks with the same
+	// overrides, the executors differ in their environment (i.e. their id)
+	// so each task runs with its own call
+	result, err := e.runTask(ctx, input)
 	if err != nil {
 		return nil, err
 	}
+	if len(result.Tasks) == 0 {
+		return nil, runTaskFailureError(result.Failures)
+	}
+
+	handle := newEcsTaskHandle(aws.StringValue(result.Tasks[0].TaskArn))
 
-	handle := &taskHandle{
-		Id: *result.Tasks[0].TaskArn,
+	waitCtx := ctx
+	if e.config.CreateTimeout != 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, e.config.CreateTimeout)
+		defer cancel()
 	}
 
 	// block until it changes state
-	for {
-		describeTasksOutput, err := e.svc.DescribeTasks(&ecs.DescribeTasksInput{
-			Cluster: aws.String(e.config.ClusterName),
-			Tasks:   []*string{aws.String(handle.Id)},
-		})
-		if err != nil {
+	if err := e.waitForRunning(waitCtx, handle); err != nil {
+		if waitCtx.Err() == nil {
 			return nil, err
 		}
-		if *describeTasksOutput.Tasks[0].LastStatus == "RUNNING" {
-			e.log.Info("task is running", "taskArn", *result.Tasks[0].TaskArn)
-			break
+
+		// the task did not reach RUNNING in time, stop it so that it does
+		// not keep running (and billing) in the background.
+		logger.Info("task did not start in time, stopping", "taskId", handle.ShortId)
+
+		if _, err := e.svc.StopTask(&ecs.StopTaskInput{
+			Cluster: aws.String(e.config.ClusterName),
+			Task:    aws.String(handle.Id),
+			Reason:  aws.String("sparkanywhere: task did not start in time"),
+		}); err != nil {
+			logger.Error("failed to stop task", "taskId", handle.ShortId, "err", err)
 		}
-		time.Sleep(5 * time.Second)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("task %s not running after %s", handle.ShortId, e.config.CreateTimeout)
 	}
 
+	logger.Info("task is running", "taskId", handle.ShortId)
+	handle.StartedAt = time.Now()
 	return handle, nil
 }
 
-func (e *ecsProvider) WaitForTask(handle *taskHandle) error {
+// runTask runs the task of the input with retries
+func (e *ecsProvider) runTask(ctx context.Context, input *ecs.RunTaskInput) (*ecs.RunTaskOutput, error) {
+	var result *ecs.RunTaskOutput
+	err := retryEcs(ctx, e.config.MaxAttempts, func() (err error) {
+		result, err = e.svc.RunTaskWithContext(ctx, input)
+		return err
+	})
+	return result, err
+}
+
+// runTaskFailureError describes why ECS did not place a task
+func runTaskFailureError(failures []*ecs.Failure) error {
+	if len(failures) == 0 {
+		return fmt.Errorf("task not started by ECS")
+	}
+	reasons := []string{}
+	for _, failure := range failures {
+		reason := aws.StringValue(failure.Reason)
+		if detail := aws.StringValue(failure.Detail); detail != "" {
+			reason += " (" + detail + ")"
+		}
+		reasons = append(reasons, reason)
+	}
+	return fmt.Errorf("task not started by ECS: %s", strings.Join(reasons, ", "))
+}
+
+func sortKeyValuePairs(pairs []*ecs.KeyValuePair) {
+	sort.Slice(pairs, func(i, j int) bool {
+		return aws.StringValue(pairs[i].Name) < aws.StringValue(pairs[j].Name)
+	})
+}
+
+// newEcsTaskHandle returns a handle for the task with the given ARN. The ARN
+// has the form arn:aws:ecs:<region>:<account>:task/<cluster>/<task-id>.
+func newEcsTaskHandle(taskArn string) *taskHandle {
+	shortId := taskArn
+	if indx := strings.LastIndex(taskArn, "/"); indx != -1 {
+		shortId = taskArn[indx+1:]
+	}
+	return &taskHandle{
+		Id:      taskArn,
+		ShortId: shortId,
+	}
+}
+
+func (e *ecsProvider) waitForRunning(ctx context.Context, handle *taskHandle) (err error) {
+	ctx, span := tracer.Start(ctx, "waitForRunning", trace.WithAttributes(attribute.String("task.id", handle.Id)))
+	defer func() { endSpan(span, err) }()
+
+	var lastStatus string
 	for {
-		describeTasksOutput, err := e.svc.DescribeTasks(&ecs.DescribeTasksInput{
+		task, err := e.poller.poll(ctx, handle.Id)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		status := aws.StringValue(task.LastStatus)
+		if status != lastStatus {
+			traceStatus(ctx, status)
+			lastStatus = status
+		}
+		if status == "RUNNING" {
+			return nil
+		}
+		if status == "STOPPED" {
+			// a short task can run and stop between two polls, WaitForTask
+			// and ExitCode report how it finished
+			if ecsTaskStarted(task) {
+				return nil
+			}
+			return e.stoppedTaskError(task)
+		}
+	}
+}
+
+// ecsTaskStarted returns whether the stopped task ran, either ECS recorded
+// its start or one of its containers exited
+func ecsTaskStarted(task *ecs.Task) bool {
+	if task.StartedAt != nil {
+		return true
+	}
+	for _, c := range task.Containers {
+		if c.ExitCode != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// stoppedTaskError describes why a task stopped before it was running
+func (e *ecsProvider) stoppedTaskError(task *ecs.Task) error {
+	reason := aws.StringValue(task.StoppedReason)
+
+	details := []string{}
+	for _, c := range task.Containers {
+		detail := aws.StringValue(c.Name) + ":"
+		if c.Reason != nil {
+			detail += " reason=" + aws.StringValue(c.Reason)
+		}
+		if c.ExitCode != nil {
+			detail += fmt.Sprintf(" exitCode=%d", aws.Int64Value(c.ExitCode))
+		}
+		details = append(details, detail)
+	}
+
+	msg := fmt.Sprintf("task stopped before running: %s", reason)
+	if len(details) != 0 {
+		msg += " (" + strings.Join(details, ", ") + ")"
+	}
+	if !e.config.assignPublicIp() && strings.Contains(msg, "CannotPullContainerError") {
+		msg += ": the task has no public ip, check that the subnets have a route to the image registry"
+	}
+	return errors.New(msg)
+}
+
+func (e *ecsProvider) describeTask(ctx context.Context, handle *taskHandle) (*ecs.DescribeTasksOutput, error) {
+	var output *ecs.DescribeTasksOutput
+	err := retryEcs(ctx, e.config.MaxAttempts, func() (err error) {
+		output, err = e.svc.DescribeTasksWithContext(ctx, &ecs.DescribeTasksInput{
 			Cluster: aws.String(e.config.ClusterName),
 			Tasks:   []*string{aws.String(handle.Id)},
 		})
+		return err
+	})
+	return output, err
+}
+
+// describeTasks describes the tasks in a single call, it is used by the poller
+func (e *ecsProvider) describeTasks(ctx context.Context, taskArns []string) (*ecs.DescribeTasksOutput, error) {
+	var output *ecs.DescribeTasksOutput
+	err := retryEcs(ctx, e.config.MaxAttempts, func() (err error) {
+		output, err = e.svc.DescribeTasksWithContext(ctx, &ecs.DescribeTasksInput{
+			Cluster: aws.String(e.config.ClusterName),
+			Tasks:   aws.StringSlice(taskArns),
+		})
+		return err
+	})
+	return output, err
+}
+
+func (e *ecsProvider) WaitForTask(ctx context.Context, handle *taskHandle) error {
+	var lastStatus string
+	for {
+		task, err := e.poller.poll(ctx, handle.Id)
 		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			return err
 		}
 
-		if describeTasksOutput.Tasks[0].LastStatus == aws.String("STOPPED") {
-			break
+		status := aws.StringValue(task.LastStatus)
+		if status != lastStatus {
+			traceStatus(ctx, status)
+			lastStatus = status
+		}
+		if status == "STOPPED" {
+			return nil
+		}
+	}
+}
+
+// TaskStatus maps the last status of the task to its phase. A stopped task
+// succeeded if its main container exited with code zero.
+func (e *ecsProvider) TaskStatus(ctx context.Context, handle *taskHandle) (TaskPhase, error) {
+	output, err := e.describeTask(ctx, handle)
+	if err != nil {
+		return "", err
+	}
+	if len(output.Tasks) == 0 {
+		return "", fmt.Errorf("task %s not found", handle.ShortId)
+	}
+	task := output.Tasks[0]
+
+	switch aws.StringValue(task.LastStatus) {
+	case "PROVISIONING", "PENDING", "ACTIVATING":
+		return TaskPending, nil
+	case "STOPPED":
+		for _, c := range task.Containers {
+			if aws.StringValue(c.Name) == e.taskDefinitionContainerName && c.ExitCode != nil && aws.Int64Value(c.ExitCode) == 0 {
+				return TaskSucceeded, nil
+			}
 		}
-		time.Sleep(1 * time.Second)
+		return TaskFailed, nil
+	default:
+		// running, or stopping (DEACTIVATING, STOPPING, DEPROVISIONING)
+		return TaskRunning, nil
+	}
+}
+
+// Ping checks that the cluster can be described
+func (e *ecsProvider) Ping(ctx context.Context) error {
+	output, err := e.svc.DescribeClustersWithContext(ctx, &ecs.DescribeClustersInput{Clusters: []*string{aws.String(e.config.ClusterName)}})
+	if err != nil {
+		return err
+	}
+	if len(output.Clusters) == 0 {
+		return fmt.Errorf("cluster not found: %s", e.config.ClusterName)
 	}
 	return nil
 }
 
-func (e *ecsProvider) GetLogs(handle *taskHandle) (string, error) {
-	return "TODO", nil
+// ExitCode returns the exit code of the main container once the task is stopped
+func (e *ecsProvider) ExitCode(ctx context.Context, handle *taskHandle) (int, bool, error) {
+	output, err := e.describeTask(ctx, handle)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(output.Tasks) == 0 {
+		return 0, false, fmt.Errorf("task %s not found", handle.ShortId)
+	}
+	task := output.Tasks[0]
+	if aws.StringValue(task.LastStatus) != "STOPPED" {
+		return 0, false, nil
+	}
+	for _, c := range task.Containers {
+		if aws.StringValue(c.Name) == e.taskDefinitionContainerName && c.ExitCode != nil {
+			return int(aws.Int64Value(c.ExitCode)), true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// GetLogs reads the CloudWatch log stream of the task from the start
+func (e *ecsProvider) GetLogs(ctx context.Context, handle *taskHandle) (string, error) {
+	input, err := e.logEventsInput(handle)
+	if err != nil {
+		return "", err
+	}
+
+	var logs strings.Builder
+	if err := e.readLogEvents(ctx, input, &logs); err != nil {
+		return "", err
+	}
+	return logs.String(), nil
+}
+
+// logEventsInput returns the input to read the log stream of the task from
+// the start
+func (e *ecsProvider) logEventsInput(handle *taskHandle) (*cloudwatchlogs.GetLogEventsInput, error) {
+	if e.taskDefinitionLogGroup == "" || e.taskDefinitionLogStreamPrefix == "" {
+		return nil, fmt.Errorf("task definition %s does not use the awslogs log driver with a stream prefix", e.taskDefinitionName)
+	}
+	return &cloudwatchlogs.GetLogEventsInput{
+		LogGroupName:  aws.String(e.taskDefinitionLogGroup),
+		LogStreamName: aws.String(e.logStreamName(handle)),
+		StartFromHead: aws.Bool(true),
+	}, nil
+}
+
+// readLogEvents writes the events of the log stream after the token of the
+// input and it moves the token forward. The log stream is created once the
+// container starts, until then there are no events.
+func (e *ecsProvider) readLogEvents(ctx context.Context, input *cloudwatchlogs.GetLogEventsInput, w io.Writer) error {
+	for {
+		var events *cloudwatchlogs.GetLogEventsOutput
+		err := retryEcs(ctx, e.config.MaxAttempts, func() (err error) {
+			events, err = e.logsSvc.GetLogEventsWithContext(ctx, input)
+			return err
+		})
+		if err != nil {
+			var awsErr awserr.Error
+			if errors.As(err, &awsErr) && awsErr.Code() == cloudwatchlogs.ErrCodeResourceNotFoundException {
+				return nil
+			}
+			return err
+		}
+
+		for _, event := range events.Events {
+			if _, err := fmt.Fprintln(w, aws.StringValue(event.Message)); err != nil {
+				return err
+			}
+		}
+
+		// the forward token is the same once there are no more events
+		if aws.StringValue(events.NextForwardToken) == aws.StringValue(input.NextToken) {
+			return nil
+		}
+		input.NextToken = events.NextForwardToken
+	}
+}
+
+// logStreamName returns the CloudWatch log stream of the task, the awslogs
+// driver names it <prefix>/<container-name>/<task-id>.
+func (e *ecsProvider) logStreamName(handle *taskHandle) string {
+	return e.taskDefinitionLogStreamPrefix + "/" + e.taskDefinitionContainerName + "/" + handle.ShortId
+}
+
+// StreamLogs polls the CloudWatch log stream of the task from the start and
+// writes the new events as they arrive until the task is stopped.
+func (e *ecsProvider) StreamLogs(ctx context.Context, handle *taskHandle, w io.Writer) error {
+	input, err := e.logEventsInput(handle)
+	if err != nil {
+		return err
+	}
+
+	for {
+		// check the status before reading the events so that the last
+		// events are read once the task is stopped
+		output, err := e.describeTask(ctx, handle)
+		if err != nil {
+			return err
+		}
+		if len(output.Tasks) == 0 {
+			return fmt.Errorf("task %s not found", handle.ShortId)
+		}
+		stopped := aws.StringValue(output.Tasks[0].LastStatus) == "STOPPED"
+
+		if err := e.readLogEvents(ctx, input, w); err != nil {
+			return err
+		}
+
+		if stopped {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(logStreamInterval):
+		}
+	}
+}
+
+func (e *ecsProvider) StopTask(ctx context.Context, handle *taskHandle) error {
+	e.log.Info("Stopping task", "taskId", handle.ShortId)
+
+	_, err := e.svc.StopTaskWithContext(ctx, &ecs.StopTaskInput{
+		Cluster: aws.String(e.config.ClusterName),
+		Task:    aws.String(handle.Id),
+		Reason:  aws.String("Stopped by sparkanywhere"),
+	})
+	return err
+}
+
+// ListOrphanedTasks returns the running tasks in the cluster launched by sparkanywhere
+// on a different run than the current one (i.e. leftovers from a crashed run).
+func (e *ecsProvider) ListOrphanedTasks(ctx context.Context, currentRunId string) ([]*taskHandle, error) {
+	taskArns := []*string{}
+	err := e.svc.ListTasksPagesWithContext(ctx, &ecs.ListTasksInput{
+		Cluster:       aws.String(e.config.ClusterName),
+		DesiredStatus: aws.String("RUNNING"),
+	}, func(page *ecs.ListTasksOutput, lastPage bool) bool {
+		taskArns = append(taskArns, page.TaskArns...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	handles := []*taskHandle{}
+
+	// DescribeTasks accepts up to 100 tasks per call
+	for len(taskArns) != 0 {
+		batch := taskArns
+		if len(batch) > 100 {
+			batch = batch[:100]
+		}
+		taskArns = taskArns[len(batch):]
+
+		output, err := e.svc.DescribeTasksWithContext(ctx, &ecs.DescribeTasksInput{
+			Cluster: aws.String(e.config.ClusterName),
+			Tasks:   batch,
+			Include: []*string{aws.String(ecs.TaskFieldTags)},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, task := range output.Tasks {
+			tags := map[string]string{}
+			for _, tag := range task.Tags {
+				tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+			}
+
+			runId, ok := tags[labelRunId]
+			if !ok || runId == currentRunId {
+				continue
+			}
+			handle := newEcsTaskHandle(aws.StringValue(task.TaskArn))
+			handle.Name = tags[labelPodName]
+			handles = append(handles, handle)
+		}
+	}
+	return handles, nil
 }
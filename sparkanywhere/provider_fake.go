@@ -0,0 +1,227 @@
+package sparkanywhere
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// FakeProvider is an in-memory provider to test the control plane without
+// docker or a cloud account. The tasks do not run anything, they keep running
+// until they are stopped or Exit is called. Set it in Config.FakeProvider.
+type FakeProvider struct {
+	lock sync.Mutex
+
+	// CreateErr is returned by CreateTask if it is set
+	CreateErr error
+
+	// Logs are the logs of the tasks by name
+	Logs map[string]string
+
+	// LogsErr is returned by GetLogs if it is set
+	LogsErr error
+
+	// tasks are the created tasks by id and in order
+	tasks   map[string]*fakeTask
+	ordered []*fakeTask
+
+	calls  []FakeCall
+	nextId int
+}
+
+// FakeCall is a call made to the FakeProvider
+type FakeCall struct {
+	Method string
+	Task   string
+}
+
+// fakeTask is a task of the FakeProvider, doneCh is closed once it exits
+type fakeTask struct {
+	task     *Task
+	exitCode int
+	doneCh   chan struct{}
+}
+
+var _ provider = &FakeProvider{}
+
+func NewFakeProvider() *FakeProvider {
+	return &FakeProvider{
+		Logs:  map[string]string{},
+		tasks: map[string]*fakeTask{},
+	}
+}
+
+func (f *FakeProvider) record(method, task string) {
+	f.calls = append(f.calls, FakeCall{Method: method, Task: task})
+}
+
+func (f *FakeProvider) get(handle *taskHandle) (*fakeTask, error) {
+	task, ok := f.tasks[handle.Id]
+	if !ok {
+		return nil, fmt.Errorf("task %s not found", handle.Id)
+	}
+	return task, nil
+}
+
+func (f *FakeProvider) CreateTask(ctx context.Context, task *Task) (*taskHandle, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.record("CreateTask", task.Name)
+	if f.CreateErr != nil {
+		return nil, f.CreateErr
+	}
+
+	f.nextId++
+	id := "fake-" + strconv.Itoa(f.nextId)
+	fake := &fakeTask{
+		task:   task,
+		doneCh: make(chan struct{}),
+	}
+	f.tasks[id] = fake
+	f.ordered = append(f.ordered, fake)
+	return &taskHandle{Id: id, ShortId: id, StartedAt: time.Now()}, nil
+}
+
+func (f *FakeProvider) WaitForTask(ctx context.Context, handle *taskHandle) error {
+	f.lock.Lock()
+	f.record("WaitForTask", handle.Name)
+	task, err := f.get(handle)
+	f.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-task.doneCh:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if task.exitCode != 0 {
+		return fmt.Errorf("task %s exited with code %d", handle.Id, task.exitCode)
+	}
+	return nil
+}
+
+func (f *FakeProvider) GetLogs(ctx context.Context, handle *taskHandle) (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.record("GetLogs", handle.Name)
+	if f.LogsErr != nil {
+		return "", f.LogsErr
+	}
+	task, err := f.get(handle)
+	if err != nil {
+		return "", err
+	}
+	return f.Logs[task.task.Name], nil
+}
+
+// StopTask makes the task exit with code 137, as if it was killed
+func (f *FakeProvider) StopTask(ctx context.Context, handle *taskHandle) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.record("StopTask", handle.Name)
+	task, err := f.get(handle)
+	if err != nil {
+		return err
+	}
+	f.exit(task, 137)
+	return nil
+}
+
+func (f *FakeProvider) TaskStatus(ctx context.Context, handle *taskHandle) (TaskPhase, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	task, err := f.get(handle)
+	if err != nil {
+		return "", err
+	}
+
+	select {
+	case <-task.doneCh:
+		if task.exitCode != 0 {
+			return TaskFailed, nil
+		}
+		return TaskSucceeded, nil
+	default:
+		return TaskRunning, nil
+	}
+}
+
+func (f *FakeProvider) ExitCode(ctx context.Context, handle *taskHandle) (int, bool, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	task, err := f.get(handle)
+	if err != nil {
+		return 0, false, err
+	}
+
+	select {
+	case <-task.doneCh:
+		return task.exitCode, true, nil
+	default:
+		return 0, false, nil
+	}
+}
+
+func (f *FakeProvider) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Exit makes the running tasks with the name exit with the code
+func (f *FakeProvider) Exit(name string, code int) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	found := false
+	for _, task := range f.ordered {
+		if task.task.Name == name {
+			f.exit(task, code)
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("task %s not found", name)
+	}
+	return nil
+}
+
+// exit closes the task once, it must be called with the lock held
+func (f *FakeProvider) exit(task *fakeTask, code int) {
+	select {
+	case <-task.doneCh:
+	default:
+		task.exitCode = code
+		close(task.doneCh)
+	}
+}
+
+// Tasks returns the tasks created in the provider in order
+func (f *FakeProvider) Tasks() []Task {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	tasks := []Task{}
+	for _, task := range f.ordered {
+		tasks = append(tasks, *task.task)
+	}
+	return tasks
+}
+
+// Calls returns the calls made to the provider in order
+func (f *FakeProvider) Calls() []FakeCall {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return append([]FakeCall{}, f.calls...)
+}
@@ -0,0 +1,454 @@
+package sparkanywhere
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+type KubernetesConfig struct {
+	// Kubeconfig is the path of the kubeconfig file of the cluster. If
+	// empty, it is resolved from the KUBECONFIG environment variable or
+	// ~/.kube/config, or the in-cluster config is used if sparkanywhere
+	// runs in a pod. The current context is used.
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+
+	// Namespace is the namespace of the pods (default: the namespace of
+	// the context or 'default')
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// kubernetesProvider runs the tasks as pods in an existing Kubernetes
+// cluster with client-go.
+type kubernetesProvider struct {
+	logger *slog.Logger
+	config *KubernetesConfig
+
+	clientset kubernetes.Interface
+	namespace string
+
+	filesWarningOnce   sync.Once
+	aliasesWarningOnce sync.Once
+}
+
+var _ provider = &kubernetesProvider{}
+
+// kubernetesContainerName is the name of the main container of the pods
+const kubernetesContainerName = "task"
+
+var kubernetesPollInterval = 1 * time.Second
+
+func newKubernetesProvider(config *KubernetesConfig) (*kubernetesProvider, error) {
+	p := &kubernetesProvider{
+		logger: slog.With("provider", "kubernetes"),
+		config: config,
+	}
+	if err := p.loadKubeconfig(); err != nil {
+		return nil, err
+	}
+
+	// check that the cluster is reachable and the credentials are valid
+	if _, err := p.pods().List(context.Background(), metav1.ListOptions{Limit: 1}); err != nil {
+		return nil, fmt.Errorf("failed to list the pods in namespace %s: %w", p.namespace, err)
+	}
+	return p, nil
+}
+
+// loadKubeconfig sets up the client with the cluster and the user of the
+// current context. The kubeconfig is loaded like kubectl does, so the exec
+// and auth provider plugins are supported, and it falls back to the
+// in-cluster config.
+func (p *kubernetesProvider) loadKubeconfig() error {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = p.config.Kubeconfig
+
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{})
+	restConfig, err := clientConfig.ClientConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+	if p.clientset, err = kubernetes.NewForConfig(restConfig); err != nil {
+		return fmt.Errorf("failed to create the kubernetes client: %w", err)
+	}
+
+	p.namespace = p.config.Namespace
+	if p.namespace == "" {
+		if p.namespace, _, err = clientConfig.Namespace(); err != nil {
+			return fmt.Errorf("failed to get the namespace of the context: %w", err)
+		}
+	}
+	if p.namespace == "" {
+		p.namespace = "default"
+	}
+	return nil
+}
+
+func (p *kubernetesProvider) pods() typedcorev1.PodInterface {
+	return p.clientset.CoreV1().Pods(p.namespace)
+}
+
+var (
+	kubernetesNameRegexp       = regexp.MustCompile(`[^a-z0-9-]+`)
+	kubernetesLabelValueRegexp = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+)
+
+// kubernetesName returns a valid prefix for the generated name of a pod
+func kubernetesName(name string) string {
+	name = kubernetesNameRegexp.ReplaceAllString(strings.ToLower(name), "-")
+	if len(name) > 50 {
+		name = name[:50]
+	}
+	name = strings.Trim(name, "-")
+	if name == "" {
+		name = "task"
+	}
+	return name + "-"
+}
+
+// kubernetesLabelValue returns a valid label value
+func kubernetesLabelValue(value string) string {
+	value = kubernetesLabelValueRegexp.ReplaceAllString(value, "-")
+	if len(value) > 63 {
+		value = value[:63]
+	}
+	return strings.Trim(value, "-_.")
+}
+
+// parseUser parses a UID[:GID] user
+func parseUser(user string) (*int64, *int64, error) {
+	uidStr, gidStr, hasGid := strings.Cut(user, ":")
+	uid, err := strconv.ParseInt(uidStr, 10, 64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid user '%s', expected UID[:GID]", user)
+	}
+	if !hasGid {
+		return &uid, nil, nil
+	}
+	gid, err := strconv.ParseInt(gidStr, 10, 64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid user '%s', expected UID[:GID]", user)
+	}
+	return &uid, &gid, nil
+}
+
+func kubernetesEnv(env map[string]string) []v1.EnvVar {
+	vars := []v1.EnvVar{}
+	for name, value := range env {
+		vars = append(vars, v1.EnvVar{Name: name, Value: value})
+	}
+	return vars
+}
+
+// taskPod maps the task to the spec of its pod
+func (p *kubernetesProvider) taskPod(task *Task) (*v1.Pod, error) {
+	main := v1.Container{
+		Name:  kubernetesContainerName,
+		Image: task.Image,
+		Args:  task.Args,
+		Env:   kubernetesEnv(task.Env),
+	}
+
+	// the limits are also the requests so that the task gets the resources
+	if task.Cpu != 0 || task.Memory != 0 {
+		resources := v1.ResourceList{}
+		if task.Cpu != 0 {
+			resources[v1.ResourceCPU] = *resource.NewMilliQuantity(task.Cpu, resource.DecimalSI)
+		}
+		if task.Memory != 0 {
+			resources[v1.ResourceMemory] = *resource.NewQuantity(task.Memory, resource.BinarySI)
+		}
+		main.Resources = v1.ResourceRequirements{Limits: resources, Requests: resources}
+	}
+	for _, port := range task.Ports {
+		main.Ports = append(main.Ports, v1.ContainerPort{ContainerPort: port, Protocol: v1.ProtocolTCP})
+	}
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: kubernetesName(task.Name),
+			Labels:       map[string]string{},
+		},
+		Spec: v1.PodSpec{
+			RestartPolicy: v1.RestartPolicyNever,
+		},
+	}
+	for key, value := range task.Labels {
+		pod.ObjectMeta.Labels[key] = kubernetesLabelValue(value)
+	}
+
+	if task.User != "" {
+		uid, gid, err := parseUser(task.User)
+		if err != nil {
+			return nil, err
+		}
+		pod.Spec.SecurityContext = &v1.PodSecurityContext{RunAsUser: uid, RunAsGroup: gid}
+	}
+	if len(task.DNSServers) != 0 {
+		pod.Spec.DNSPolicy = v1.DNSNone
+		pod.Spec.DNSConfig = &v1.PodDNSConfig{Nameservers: task.DNSServers}
+	}
+
+	for i, m := range task.Mounts {
+		name := fmt.Sprintf("mount-%d", i)
+		pod.Spec.Volumes = append(pod.Spec.Volumes, v1.Volume{
+			Name: name,
+			VolumeSource: v1.VolumeSource{
+				HostPath: &v1.HostPathVolumeSource{Path: m.HostPath},
+			},
+		})
+		main.VolumeMounts = append(main.VolumeMounts, v1.VolumeMount{
+			Name:      name,
+			MountPath: m.ContainerPath,
+			ReadOnly:  m.ReadOnly,
+		})
+	}
+
+	pod.Spec.Containers = append(pod.Spec.Containers, main)
+	for _, sidecar := range task.Sidecars {
+		pod.Spec.Containers = append(pod.Spec.Containers, v1.Container{
+			Name:    sidecar.Name,
+			Image:   sidecar.Image,
+			Command: sidecar.Command,
+			Args:    sidecar.Args,
+			Env:     kubernetesEnv(sidecar.Env),
+		})
+	}
+	return pod, nil
+}
+
+func (p *kubernetesProvider) CreateTask(ctx context.Context, task *Task) (*taskHandle, error) {
+	logger := taskLogger(p.logger, task)
+
+	// the files and the aliases would need config maps and services
+	if len(task.Files) != 0 {
+		p.filesWarningOnce.Do(func() {
+			logger.Warn("config map volumes are not supported on kubernetes, they are ignored")
+		})
+	}
+	if len(task.Aliases) != 0 {
+		p.aliasesWarningOnce.Do(func() {
+			logger.Warn("services are not supported on kubernetes, use the client deploy mode")
+		})
+	}
+
+	pod, err := p.taskPod(task)
+	if err != nil {
+		return nil, err
+	}
+
+	created, err := p.pods().Create(ctx, pod, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	traceStatus(ctx, "created")
+
+	handle := &taskHandle{
+		Id:      created.ObjectMeta.Name,
+		ShortId: created.ObjectMeta.Name,
+	}
+
+	if err := p.waitForStart(ctx, handle); err != nil {
+		if err := p.RemoveTask(context.Background(), handle); err != nil {
+			logger.Error("failed to delete pod", "name", handle.Id, "err", err)
+		}
+		return nil, err
+	}
+	traceStatus(ctx, "running")
+
+	handle.StartedAt = time.Now()
+	return handle, nil
+}
+
+// kubernetesWaitingErrors are the reasons of a waiting container that will
+// not start without a change
+var kubernetesWaitingErrors = map[string]struct{}{
+	"ErrImagePull":               {},
+	"ImagePullBackOff":           {},
+	"InvalidImageName":           {},
+	"CreateContainerConfigError": {},
+	"CreateContainerError":       {},
+}
+
+// waitForStart waits until the pod is not pending anymore
+func (p *kubernetesProvider) waitForStart(ctx context.Context, handle *taskHandle) (err error) {
+	ctx, span := tracer.Start(ctx, "waitForStart", trace.WithAttributes(attribute.String("task.id", handle.Id)))
+	defer func() { endSpan(span, err) }()
+
+	for {
+		pod, err := p.getPod(ctx, handle)
+		if err != nil {
+			return err
+		}
+		if pod.Status.Phase != v1.PodPending {
+			return nil
+		}
+		for _, status := range pod.Status.ContainerStatuses {
+			if waiting := status.State.Waiting; waiting != nil {
+				if _, ok := kubernetesWaitingErrors[waiting.Reason]; ok {
+					return fmt.Errorf("container %s of pod %s cannot start: %s %s", status.Name, handle.Id, waiting.Reason, waiting.Message)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(kubernetesPollInterval):
+		}
+	}
+}
+
+func (p *kubernetesProvider) getPod(ctx context.Context, handle *taskHandle) (*v1.Pod, error) {
+	return p.pods().Get(ctx, handle.Id, metav1.GetOptions{})
+}
+
+func (p *kubernetesProvider) WaitForTask(ctx context.Context, handle *taskHandle) error {
+	var lastPhase v1.PodPhase
+	for {
+		pod, err := p.getPod(ctx, handle)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if apierrors.IsNotFound(err) {
+				return fmt.Errorf("pod %s not found, it was deleted", handle.Id)
+			}
+			return err
+		}
+
+		if pod.Status.Phase != lastPhase {
+			traceStatus(ctx, string(pod.Status.Phase))
+			lastPhase = pod.Status.Phase
+		}
+
+		switch pod.Status.Phase {
+		case v1.PodSucceeded:
+			return nil
+		case v1.PodFailed:
+			return podFailure(pod)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(kubernetesPollInterval):
+		}
+	}
+}
+
+// podFailure returns the error of a failed pod with the exit code of its
+// main container
+func podFailure(pod *v1.Pod) error {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name != kubernetesContainerName || status.State.Terminated == nil {
+			continue
+		}
+		terminated := status.State.Terminated
+		return fmt.Errorf("pod %s failed with exit code %d: %s %s", pod.ObjectMeta.Name, terminated.ExitCode, terminated.Reason, terminated.Message)
+	}
+	return fmt.Errorf("pod %s failed: %s %s", pod.ObjectMeta.Name, pod.Status.Reason, pod.Status.Message)
+}
+
+// TaskStatus maps the phase of the pod to the phase of the task
+func (p *kubernetesProvider) TaskStatus(ctx context.Context, handle *taskHandle) (TaskPhase, error) {
+	pod, err := p.getPod(ctx, handle)
+	if err != nil {
+		return "", err
+	}
+	switch pod.Status.Phase {
+	case v1.PodPending:
+		return TaskPending, nil
+	case v1.PodSucceeded:
+		return TaskSucceeded, nil
+	case v1.PodFailed:
+		return TaskFailed, nil
+	default:
+		return TaskRunning, nil
+	}
+}
+
+// Ping checks that the API server is reachable
+func (p *kubernetesProvider) Ping(ctx context.Context) error {
+	return p.clientset.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx).Error()
+}
+
+// ExitCode returns the exit code of the main container once it has terminated
+func (p *kubernetesProvider) ExitCode(ctx context.Context, handle *taskHandle) (int, bool, error) {
+	pod, err := p.getPod(ctx, handle)
+	if err != nil {
+		return 0, false, err
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name == kubernetesContainerName && status.State.Terminated != nil {
+			return int(status.State.Terminated.ExitCode), true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+func (p *kubernetesProvider) logsRequest(handle *taskHandle, follow bool) *rest.Request {
+	return p.pods().GetLogs(handle.Id, &v1.PodLogOptions{
+		Container: kubernetesContainerName,
+		Follow:    follow,
+	})
+}
+
+func (p *kubernetesProvider) GetLogs(ctx context.Context, handle *taskHandle) (string, error) {
+	data, err := p.logsRequest(handle, false).DoRaw(ctx)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// StreamLogs follows the logs of the main container until it exits
+func (p *kubernetesProvider) StreamLogs(ctx context.Context, handle *taskHandle, w io.Writer) error {
+	stream, err := p.logsRequest(handle, true).Stream(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	if _, err := io.Copy(w, stream); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// StopTask kills the containers of the pod by setting an active deadline
+// that already passed. The pod is kept with its logs until it is removed.
+func (p *kubernetesProvider) StopTask(ctx context.Context, handle *taskHandle) error {
+	patch := []byte(`{"spec":{"activeDeadlineSeconds":1}}`)
+	_, err := p.pods().Patch(ctx, handle.Id, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// RemoveTask deletes the pod
+func (p *kubernetesProvider) RemoveTask(ctx context.Context, handle *taskHandle) error {
+	err := p.pods().Delete(ctx, handle.Id, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,734 @@
+package sparkanywhere
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type NomadConfig struct {
+	// Address is the address of the Nomad API (default: NOMAD_ADDR or
+	// http://127.0.0.1:4646)
+	Address string `json:"address,omitempty"`
+
+	// Region and Namespace of the jobs. Empty uses the defaults of the agent.
+	Region    string `json:"region,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+
+	// Datacenters where the jobs are placed (default: all)
+	Datacenters []string `json:"datacenters,omitempty"`
+
+	// Token is the ACL token of the API (default: NOMAD_TOKEN)
+	Token string `json:"token,omitempty"`
+
+	// NetworkMode is the docker network mode of the tasks (default: host)
+	// so that the executors and the driver reach each other across nodes.
+	NetworkMode string `json:"networkMode,omitempty"`
+}
+
+// nomadProvider runs the tasks as dispatched jobs of parameterized batch
+// jobs with a docker task in a Nomad cluster. A parameterized job is
+// registered once per spec (image, resources, mounts...) and the values that
+// change between the tasks of the same spec (i.e. the arguments and the env)
+// are dispatched as meta. It talks to the HTTP API of Nomad directly.
+type nomadProvider struct {
+	logger *slog.Logger
+	config *NomadConfig
+	client *http.Client
+
+	// registered are the ids of the parameterized jobs registered in this
+	// run, the lock is held while a job is registered
+	registered     map[string]struct{}
+	registeredLock sync.Mutex
+
+	filesWarningOnce   sync.Once
+	aliasesWarningOnce sync.Once
+}
+
+var _ provider = &nomadProvider{}
+
+// nomadTaskName is the name of the main task of the jobs
+const nomadTaskName = "task"
+
+var (
+	defaultNomadAddress     = "http://127.0.0.1:4646"
+	defaultNomadNetworkMode = "host"
+	nomadPollInterval       = 1 * time.Second
+)
+
+func newNomadProvider(config *NomadConfig) (*nomadProvider, error) {
+	if config.Address == "" {
+		config.Address = os.Getenv("NOMAD_ADDR")
+	}
+	if config.Address == "" {
+		config.Address = defaultNomadAddress
+	}
+	config.Address = strings.TrimSuffix(config.Address, "/")
+	if config.Token == "" {
+		config.Token = os.Getenv("NOMAD_TOKEN")
+	}
+	if config.NetworkMode == "" {
+		config.NetworkMode = defaultNomadNetworkMode
+	}
+
+	p := &nomadProvider{
+		logger:     slog.With("provider", "nomad"),
+		config:     config,
+		client:     &http.Client{},
+		registered: map[string]struct{}{},
+	}
+
+	// check that the agent is reachable and the token is valid
+	if err := p.do(context.Background(), http.MethodGet, "/v1/jobs", nil, nil, nil); err != nil {
+		return nil, fmt.Errorf("failed to list the nomad jobs: %w", err)
+	}
+	return p, nil
+}
+
+// nomadError is an error response of the Nomad API
+type nomadError struct {
+	code    int
+	message string
+}
+
+func (e *nomadError) Error() string {
+	return fmt.Sprintf("nomad api error (%d): %s", e.code, e.message)
+}
+
+func isNomadNotFound(err error) bool {
+	var nerr *nomadError
+	return errors.As(err, &nerr) && nerr.code == http.StatusNotFound
+}
+
+// request sends a request to the Nomad API. The body of the response must
+// be closed by the caller.
+func (p *nomadProvider) request(ctx context.Context, method, path string, query url.Values, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	if query == nil {
+		query = url.Values{}
+	}
+	if p.config.Region != "" {
+		query.Set("region", p.config.Region)
+	}
+	if p.config.Namespace != "" {
+		query.Set("namespace", p.config.Namespace)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.config.Address+path+"?"+query.Encode(), reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if p.config.Token != "" {
+		req.Header.Set("X-Nomad-Token", p.config.Token)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+
+		data, _ := io.ReadAll(resp.Body)
+		return nil, &nomadError{code: resp.StatusCode, message: strings.TrimSpace(string(data))}
+	}
+	return resp, nil
+}
+
+// do sends a request to the Nomad API and decodes the response in out
+func (p *nomadProvider) do(ctx context.Context, method, path string, query url.Values, body interface{}, out interface{}) error {
+	resp, err := p.request(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// The types below are the subset of the Nomad API used by the provider
+
+type nomadJob struct {
+	ID               string
+	Name             string
+	Type             string
+	Region           string `json:",omitempty"`
+	Namespace        string `json:",omitempty"`
+	Datacenters      []string
+	ParameterizedJob *nomadParameterizedJob
+	TaskGroups       []*nomadTaskGroup
+}
+
+type nomadParameterizedJob struct {
+	Payload      string
+	MetaRequired []string
+	MetaOptional []string
+}
+
+type nomadDispatchResponse struct {
+	DispatchedJobID string
+}
+
+type nomadTaskGroup struct {
+	Name             string
+	Count            int
+	RestartPolicy    *nomadRestartPolicy
+	ReschedulePolicy *nomadReschedulePolicy
+	Tasks            []*nomadTask
+}
+
+type nomadRestartPolicy struct {
+	Attempts int
+	Mode     string
+}
+
+type nomadReschedulePolicy struct {
+	Attempts  int
+	Unlimited bool
+}
+
+type nomadTask struct {
+	Name      string
+	Driver    string
+	User      string `json:",omitempty"`
+	Config    map[string]interface{}
+	Env       map[string]string
+	Resources *nomadResources `json:",omitempty"`
+	Lifecycle *nomadLifecycle `json:",omitempty"`
+}
+
+type nomadResources struct {
+	CPU      int `json:",omitempty"`
+	MemoryMB int `json:",omitempty"`
+}
+
+type nomadLifecycle struct {
+	Hook    string
+	Sidecar bool
+}
+
+type nomadAllocation struct {
+	ID           string
+	ClientStatus string
+	CreateIndex  uint64
+	TaskStates   map[string]*nomadTaskState
+}
+
+type nomadTaskState struct {
+	State  string
+	Failed bool
+	Events []*nomadTaskEvent
+}
+
+type nomadTaskEvent struct {
+	Type           string
+	ExitCode       int
+	DisplayMessage string
+}
+
+// nomadParams collects the values of a task that change between the tasks of
+// the same spec. They are dispatched as meta and interpolated in the job.
+type nomadParams struct {
+	meta map[string]string
+}
+
+// param returns the interpolation of a new meta key with the value
+func (n *nomadParams) param(value string) string {
+	key := "p" + strconv.Itoa(len(n.meta))
+	n.meta[key] = value
+	return "${NOMAD_META_" + key + "}"
+}
+
+func (n *nomadParams) list(values []string) []string {
+	params := []string{}
+	for _, value := range values {
+		params = append(params, n.param(value))
+	}
+	return params
+}
+
+// values returns the map with the values as params, in the order of the keys
+func (n *nomadParams) values(values map[string]string) map[string]string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	params := map[string]string{}
+	for _, key := range keys {
+		params[key] = n.param(values[key])
+	}
+	return params
+}
+
+// dockerConfig returns the config of the docker driver for the image. The
+// maps of the driver config are lists of maps in the JSON API.
+func (p *nomadProvider) dockerConfig(image string, labels map[string]string) map[string]interface{} {
+	config := map[string]interface{}{
+		"image":        image,
+		"network_mode": p.config.NetworkMode,
+	}
+	if len(labels) != 0 {
+		config["labels"] = []map[string]string{labels}
+	}
+	return config
+}
+
+// taskJob maps the task to a parameterized batch job with a single
+// allocation per dispatch that is neither restarted nor rescheduled, like a
+// pod with a Never restart policy. It returns the job without its id and the
+// meta to dispatch it with. The labels are also set in the meta of the
+// dispatched job.
+func (p *nomadProvider) taskJob(task *Task) (*nomadJob, map[string]string) {
+	params := &nomadParams{meta: map[string]string{}}
+	labels := params.values(task.Labels)
+
+	config := p.dockerConfig(task.Image, labels)
+	if len(task.Args) != 0 {
+		config["args"] = params.list(task.Args)
+	}
+	if len(task.DNSServers) != 0 {
+		config["dns_servers"] = task.DNSServers
+	}
+	if len(task.Mounts) != 0 {
+		volumes := []string{}
+		for _, m := range task.Mounts {
+			volume := m.HostPath + ":" + m.ContainerPath
+			if m.ReadOnly {
+				volume += ":ro"
+			}
+			volumes = append(volumes, volume)
+		}
+		config["volumes"] = volumes
+	}
+
+	main := &nomadTask{
+		Name:   nomadTaskName,
+		Driver: "docker",
+		User:   task.User,
+		Config: config,
+		Env:    params.values(task.Env),
+	}
+
+	// nomad measures the cpu in MHz, a millicore is taken as a MHz
+	if task.Cpu != 0 || task.Memory != 0 {
+		main.Resources = &nomadResources{
+			CPU:      int(task.Cpu),
+			MemoryMB: int(task.Memory / (1024 * 1024)),
+		}
+	}
+
+	group := &nomadTaskGroup{
+		Name:             "task",
+		Count:            1,
+		RestartPolicy:    &nomadRestartPolicy{Attempts: 0, Mode: "fail"},
+		ReschedulePolicy: &nomadReschedulePolicy{Attempts: 0, Unlimited: false},
+		Tasks:            []*nomadTask{main},
+	}
+	for _, sidecar := range task.Sidecars {
+		sidecarConfig := p.dockerConfig(sidecar.Image, labels)
+		if len(sidecar.Command) != 0 {
+			sidecarConfig["entrypoint"] = params.list(sidecar.Command)
+		}
+		if len(sidecar.Args) != 0 {
+			sidecarConfig["args"] = params.list(sidecar.Args)
+		}
+		group.Tasks = append(group.Tasks, &nomadTask{
+			Name:      sidecar.Name,
+			Driver:    "docker",
+			User:      task.User,
+			Config:    sidecarConfig,
+			Env:       params.values(sidecar.Env),
+			Lifecycle: &nomadLifecycle{Hook: "prestart", Sidecar: true},
+		})
+	}
+
+	parameterized := &nomadParameterizedJob{
+		Payload:      "forbidden",
+		MetaRequired: []string{},
+		MetaOptional: []string{},
+	}
+	for key := range params.meta {
+		parameterized.MetaRequired = append(parameterized.MetaRequired, key)
+	}
+	sort.Strings(parameterized.MetaRequired)
+
+	meta := params.meta
+	for key, value := range task.Labels {
+		parameterized.MetaOptional = append(parameterized.MetaOptional, key)
+		meta[key] = value
+	}
+	sort.Strings(parameterized.MetaOptional)
+
+	job := &nomadJob{
+		Type:             "batch",
+		Region:           p.config.Region,
+		Namespace:        p.config.Namespace,
+		Datacenters:      p.config.Datacenters,
+		ParameterizedJob: parameterized,
+		TaskGroups:       []*nomadTaskGroup{group},
+	}
+	return job, meta
+}
+
+// registerJob registers the parameterized job unless it was registered in
+// this run already. Its id is the hash of the spec, so the tasks with the
+// same spec share it (also across runs).
+func (p *nomadProvider) registerJob(ctx context.Context, job *nomadJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(data)
+	job.ID = "sparkanywhere-" + hex.EncodeToString(hash[:])[:16]
+	job.Name = job.ID
+
+	p.registeredLock.Lock()
+	defer p.registeredLock.Unlock()
+
+	if _, ok := p.registered[job.ID]; ok {
+		return nil
+	}
+	body := map[string]interface{}{
+		"Job": job,
+	}
+	if err := p.do(ctx, http.MethodPut, "/v1/jobs", nil, body, nil); err != nil {
+		return fmt.Errorf("failed to register nomad job %s: %w", job.ID, err)
+	}
+	p.registered[job.ID] = struct{}{}
+	return nil
+}
+
+func (p *nomadProvider) CreateTask(ctx context.Context, task *Task) (*taskHandle, error) {
+	logger := taskLogger(p.logger, task)
+
+	if len(task.Files) != 0 {
+		p.filesWarningOnce.Do(func() {
+			logger.Warn("config map volumes are not supported on nomad, they are ignored")
+		})
+	}
+	if len(task.Aliases) != 0 {
+		p.aliasesWarningOnce.Do(func() {
+			logger.Warn("services are not supported on nomad, use the client deploy mode")
+		})
+	}
+
+	job, meta := p.taskJob(task)
+	if err := p.registerJob(ctx, job); err != nil {
+		return nil, err
+	}
+
+	body := map[string]interface{}{
+		"JobID": job.ID,
+		"Meta":  meta,
+	}
+	var dispatched nomadDispatchResponse
+	if err := p.do(ctx, http.MethodPut, "/v1/job/"+url.PathEscape(job.ID)+"/dispatch", nil, body, &dispatched); err != nil {
+		return nil, fmt.Errorf("failed to dispatch nomad job %s: %w", job.ID, err)
+	}
+	traceStatus(ctx, "created")
+
+	// the dispatched jobs are named <parent id>/dispatch-<time>-<random>
+	handle := &taskHandle{
+		Id:      dispatched.DispatchedJobID,
+		ShortId: strings.TrimPrefix(dispatched.DispatchedJobID, job.ID+"/"),
+	}
+
+	if err := p.waitForStart(ctx, handle); err != nil {
+		if err := p.RemoveTask(context.Background(), handle); err != nil {
+			logger.Error("failed to remove job", "id", handle.Id, "err", err)
+		}
+		return nil, err
+	}
+	traceStatus(ctx, "running")
+
+	handle.StartedAt = time.Now()
+	return handle, nil
+}
+
+// allocation returns the latest allocation of the job of the task or nil
+// if it is not placed yet
+func (p *nomadProvider) allocation(ctx context.Context, handle *taskHandle) (*nomadAllocation, error) {
+	var allocs []*nomadAllocation
+	if err := p.do(ctx, http.MethodGet, "/v1/job/"+url.PathEscape(handle.Id)+"/allocations", nil, nil, &allocs); err != nil {
+		return nil, err
+	}
+	if len(allocs) == 0 {
+		return nil, nil
+	}
+	sort.Slice(allocs, func(i, j int) bool {
+		return allocs[i].CreateIndex > allocs[j].CreateIndex
+	})
+	return allocs[0], nil
+}
+
+// waitForStart waits until the allocation of the task is not pending
+func (p *nomadProvider) waitForStart(ctx context.Context, handle *taskHandle) (err error) {
+	ctx, span := tracer.Start(ctx, "waitForStart", trace.WithAttributes(attribute.String("task.id", handle.Id)))
+	defer func() { endSpan(span, err) }()
+
+	for {
+		alloc, err := p.allocation(ctx, handle)
+		if err != nil {
+			return err
+		}
+		if alloc != nil && alloc.ClientStatus != "pending" {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(nomadPollInterval):
+		}
+	}
+}
+
+func (p *nomadProvider) WaitForTask(ctx context.Context, handle *taskHandle) error {
+	var lastStatus string
+	for {
+		alloc, err := p.allocation(ctx, handle)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		if alloc != nil {
+			if alloc.ClientStatus != lastStatus {
+				traceStatus(ctx, alloc.ClientStatus)
+				lastStatus = alloc.ClientStatus
+			}
+
+			switch alloc.ClientStatus {
+			case "complete":
+				return nil
+			case "failed", "lost":
+				return allocationFailure(handle, alloc)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(nomadPollInterval):
+		}
+	}
+}
+
+// allocationFailure returns the error of a failed allocation with the exit
+// code of its main task
+func allocationFailure(handle *taskHandle, alloc *nomadAllocation) error {
+	if state, ok := alloc.TaskStates[nomadTaskName]; ok {
+		for i := len(state.Events) - 1; i >= 0; i-- {
+			if event := state.Events[i]; event.Type == "Terminated" {
+				return fmt.Errorf("job %s failed with exit code %d: %s", handle.Id, event.ExitCode, event.DisplayMessage)
+			}
+		}
+	}
+	return fmt.Errorf("job %s %s", handle.Id, alloc.ClientStatus)
+}
+
+// TaskStatus maps the client status of the allocation to the phase of the task
+func (p *nomadProvider) TaskStatus(ctx context.Context, handle *taskHandle) (TaskPhase, error) {
+	alloc, err := p.allocation(ctx, handle)
+	if err != nil {
+		return "", err
+	}
+	if alloc == nil {
+		return TaskPending, nil
+	}
+	switch alloc.ClientStatus {
+	case "pending":
+		return TaskPending, nil
+	case "complete":
+		return TaskSucceeded, nil
+	case "failed", "lost":
+		return TaskFailed, nil
+	default:
+		return TaskRunning, nil
+	}
+}
+
+// Ping checks that the Nomad API is reachable and that it has a leader
+func (p *nomadProvider) Ping(ctx context.Context) error {
+	var leader string
+	return p.do(ctx, http.MethodGet, "/v1/status/leader", nil, nil, &leader)
+}
+
+// ExitCode returns the exit code of the main task once it has terminated
+func (p *nomadProvider) ExitCode(ctx context.Context, handle *taskHandle) (int, bool, error) {
+	alloc, err := p.allocation(ctx, handle)
+	if err != nil || alloc == nil {
+		return 0, false, err
+	}
+	if state, ok := alloc.TaskStates[nomadTaskName]; ok && state.State == "dead" {
+		for i := len(state.Events) - 1; i >= 0; i-- {
+			if event := state.Events[i]; event.Type == "Terminated" {
+				return event.ExitCode, true, nil
+			}
+		}
+	}
+	return 0, false, nil
+}
+
+// logs returns the reader of the stdout or stderr logs of the main task
+func (p *nomadProvider) logs(ctx context.Context, handle *taskHandle, logType string, follow bool) (io.ReadCloser, error) {
+	alloc, err := p.allocation(ctx, handle)
+	if err != nil {
+		return nil, err
+	}
+	if alloc == nil {
+		return nil, fmt.Errorf("job %s has no allocation", handle.Id)
+	}
+
+	query := url.Values{}
+	query.Set("task", nomadTaskName)
+	query.Set("type", logType)
+	query.Set("origin", "start")
+	query.Set("plain", "true")
+	if follow {
+		query.Set("follow", "true")
+	}
+	resp, err := p.request(ctx, http.MethodGet, "/v1/client/fs/logs/"+alloc.ID, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (p *nomadProvider) readLogs(ctx context.Context, handle *taskHandle, logType string) (string, error) {
+	reader, err := p.logs(ctx, handle, logType, false)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (p *nomadProvider) GetStdLogs(ctx context.Context, handle *taskHandle) (string, string, error) {
+	stdout, err := p.readLogs(ctx, handle, "stdout")
+	if err != nil {
+		return "", "", err
+	}
+	stderr, err := p.readLogs(ctx, handle, "stderr")
+	if err != nil {
+		return "", "", err
+	}
+	return stdout, stderr, nil
+}
+
+// GetLogs returns the stdout followed by the stderr of the task, nomad
+// keeps them in different files
+func (p *nomadProvider) GetLogs(ctx context.Context, handle *taskHandle) (string, error) {
+	stdout, stderr, err := p.GetStdLogs(ctx, handle)
+	if err != nil {
+		return "", err
+	}
+	return stdout + stderr, nil
+}
+
+// lockedWriter serializes the writes of the stdout and stderr streams
+type lockedWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func (l *lockedWriter) Write(b []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.w.Write(b)
+}
+
+// StreamLogs follows the stdout and the stderr of the main task until it exits
+func (p *nomadProvider) StreamLogs(ctx context.Context, handle *taskHandle, w io.Writer) error {
+	lw := &lockedWriter{w: w}
+
+	errCh := make(chan error, 2)
+	for _, logType := range []string{"stdout", "stderr"} {
+		go func(logType string) {
+			reader, err := p.logs(ctx, handle, logType, true)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			defer reader.Close()
+
+			_, err = io.Copy(lw, reader)
+			errCh <- err
+		}(logType)
+	}
+
+	var err error
+	for i := 0; i < 2; i++ {
+		if streamErr := <-errCh; streamErr != nil && err == nil && ctx.Err() == nil {
+			err = streamErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// StopTask stops the dispatched job, its allocation and logs are kept until
+// the job is removed (or garbage collected by nomad)
+func (p *nomadProvider) StopTask(ctx context.Context, handle *taskHandle) error {
+	err := p.do(ctx, http.MethodDelete, "/v1/job/"+url.PathEscape(handle.Id), nil, nil, nil)
+	if err != nil && !isNomadNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// RemoveTask stops and purges the dispatched job, the parameterized job is
+// kept for the next tasks with the same spec
+func (p *nomadProvider) RemoveTask(ctx context.Context, handle *taskHandle) error {
+	query := url.Values{}
+	query.Set("purge", "true")
+
+	err := p.do(ctx, http.MethodDelete, "/v1/job/"+url.PathEscape(handle.Id), query, nil, nil)
+	if err != nil && !isNomadNotFound(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package sparkanywhere
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// processProvider runs the tasks as local processes. The image and most of
+// the settings of the task are ignored, the args are the command to run.
+// It is meant to exercise the control plane without docker (i.e. in CI).
+type processProvider struct {
+	logger *slog.Logger
+
+	processes     map[string]*localProcess
+	processesLock sync.Mutex
+
+	imageWarningOnce sync.Once
+}
+
+var _ provider = &processProvider{}
+
+// localProcess is a running (or exited) process of a task
+type localProcess struct {
+	cmd *exec.Cmd
+
+	combined, stdout, stderr logBuffer
+
+	// doneCh is closed once the process exits, err is its exit error
+	doneCh chan struct{}
+	err    error
+}
+
+func newProcessProvider() *processProvider {
+	return &processProvider{
+		logger:    slog.With("provider", "local"),
+		processes: map[string]*localProcess{},
+	}
+}
+
+func (p *processProvider) CreateTask(ctx context.Context, task *Task) (*taskHandle, error) {
+	logger := taskLogger(p.logger, task)
+
+	if len(task.Args) == 0 {
+		return nil, fmt.Errorf("task %s has no command to run", task.Name)
+	}
+	if task.Image != "" {
+		p.imageWarningOnce.Do(func() {
+			logger.Warn("the local provider ignores the images, the args run in the host", "image", task.Image)
+		})
+	}
+
+	proc := &localProcess{
+		doneCh: make(chan struct{}),
+	}
+
+	// the process is not bound to ctx, it runs until it exits or it is stopped
+	cmd := exec.Command(task.Args[0], task.Args[1:]...)
+	cmd.Env = os.Environ()
+	for name, value := range task.Env {
+		cmd.Env = append(cmd.Env, name+"="+value)
+	}
+	cmd.Stdout = io.MultiWriter(&proc.stdout, &proc.combined)
+	cmd.Stderr = io.MultiWriter(&proc.stderr, &proc.combined)
+	proc.cmd = cmd
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start task %s: %w", task.Name, err)
+	}
+	traceStatus(ctx, "running")
+
+	go func() {
+		proc.err = cmd.Wait()
+		close(proc.doneCh)
+	}()
+
+	id := strconv.Itoa(cmd.Process.Pid)
+
+	p.processesLock.Lock()
+	p.processes[id] = proc
+	p.processesLock.Unlock()
+
+	handle := &taskHandle{
+		Id:        id,
+		ShortId:   id,
+		StartedAt: time.Now(),
+	}
+	return handle, nil
+}
+
+func (p *processProvider) get(handle *taskHandle) (*localProcess, error) {
+	p.processesLock.Lock()
+	defer p.processesLock.Unlock()
+
+	proc, ok := p.processes[handle.Id]
+	if !ok {
+		return nil, fmt.Errorf("process %s not found", handle.Id)
+	}
+	return proc, nil
+}
+
+func (p *processProvider) WaitForTask(ctx context.Context, handle *taskHandle) error {
+	proc, err := p.get(handle)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-proc.doneCh:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if proc.err != nil {
+		if stderr := lastLines(proc.stderr.String(), dockerExitErrorLines); stderr != "" {
+			return fmt.Errorf("process %s failed: %w\n%s", handle.Id, proc.err, stderr)
+		}
+		return fmt.Errorf("process %s failed: %w", handle.Id, proc.err)
+	}
+	return nil
+}
+
+func (p *processProvider) GetLogs(ctx context.Context, handle *taskHandle) (string, error) {
+	proc, err := p.get(handle)
+	if err != nil {
+		return "", err
+	}
+	return proc.combined.String(), nil
+}
+
+func (p *processProvider) GetStdLogs(ctx context.Context, handle *taskHandle) (string, string, error) {
+	proc, err := p.get(handle)
+	if err != nil {
+		return "", "", err
+	}
+	return proc.stdout.String(), proc.stderr.String(), nil
+}
+
+// TaskStatus returns running until the process exits
+func (p *processProvider) TaskStatus(ctx context.Context, handle *taskHandle) (TaskPhase, error) {
+	proc, err := p.get(handle)
+	if err != nil {
+		return "", err
+	}
+
+	select {
+	case <-proc.doneCh:
+		if proc.err != nil {
+			return TaskFailed, nil
+		}
+		return TaskSucceeded, nil
+	default:
+		return TaskRunning, nil
+	}
+}
+
+// ExitCode returns the exit code of the process once it has exited, it is
+// -1 if the process was killed by a signal
+func (p *processProvider) ExitCode(ctx context.Context, handle *taskHandle) (int, bool, error) {
+	proc, err := p.get(handle)
+	if err != nil {
+		return 0, false, err
+	}
+
+	select {
+	case <-proc.doneCh:
+		return proc.cmd.ProcessState.ExitCode(), true, nil
+	default:
+		return 0, false, nil
+	}
+}
+
+// StopTask kills the process if it is still running
+func (p *processProvider) StopTask(ctx context.Context, handle *taskHandle) error {
+	proc, err := p.get(handle)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-proc.doneCh:
+		return nil
+	default:
+	}
+	if err := proc.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+	<-proc.doneCh
+	return nil
+}
@@ -0,0 +1,201 @@
+package sparkanywhere
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// annotationProvider is the pod annotation to select the provider of its task
+const annotationProvider = "sparkanywhere.io/provider"
+
+// availableProviders are the names of the providers that can be enabled
+var availableProviders = []string{"docker", "ecs", "kubernetes", "local", "nomad"}
+
+// providerRegistry is a provider that dispatches the tasks to the configured
+// providers by name. Tasks are created in the provider selected in Task.Provider
+// (or the default one) and the handle records it for the rest of the calls.
+type providerRegistry struct {
+	providers   map[string]provider
+	defaultName string
+}
+
+var _ provider = &providerRegistry{}
+
+func newProviderRegistry(providers map[string]provider, defaultName string) (*providerRegistry, error) {
+	if len(providers) == 0 {
+		return nil, fmt.Errorf("no provider configured")
+	}
+	if defaultName == "" {
+		if len(providers) != 1 {
+			return nil, fmt.Errorf("a default provider is required when more than one provider is enabled (%v)", providerNames(providers))
+		}
+		for name := range providers {
+			defaultName = name
+		}
+	}
+	if _, ok := providers[defaultName]; !ok {
+		if !slices.Contains(availableProviders, defaultName) {
+			return nil, fmt.Errorf("unknown default provider '%s', expected one of: %s", defaultName, strings.Join(availableProviders, ", "))
+		}
+		return nil, fmt.Errorf("default provider '%s' is not enabled (%v)", defaultName, providerNames(providers))
+	}
+
+	r := &providerRegistry{
+		providers:   providers,
+		defaultName: defaultName,
+	}
+	return r, nil
+}
+
+func providerNames(providers map[string]provider) []string {
+	names := []string{}
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (r *providerRegistry) CreateTask(ctx context.Context, task *Task) (*taskHandle, error) {
+	name := task.Provider
+	if name == "" {
+		name = r.defaultName
+	} else if _, ok := r.providers[name]; !ok {
+		slog.Warn("provider not enabled, using the default one", "task", task.Name, "provider", name, "default", r.defaultName)
+		name = r.defaultName
+	}
+
+	handle, err := r.providers[name].CreateTask(ctx, task)
+	if err != nil {
+		return nil, err
+	}
+	handle.Provider = name
+	return handle, nil
+}
+
+func (r *providerRegistry) get(handle *taskHandle) (provider, error) {
+	p, ok := r.providers[handle.Provider]
+	if !ok {
+		return nil, fmt.Errorf("provider '%s' of task %s not found", handle.Provider, handle.Id)
+	}
+	return p, nil
+}
+
+func (r *providerRegistry) WaitForTask(ctx context.Context, handle *taskHandle) error {
+	p, err := r.get(handle)
+	if err != nil {
+		return err
+	}
+	return p.WaitForTask(ctx, handle)
+}
+
+func (r *providerRegistry) GetLogs(ctx context.Context, handle *taskHandle) (string, error) {
+	p, err := r.get(handle)
+	if err != nil {
+		return "", err
+	}
+	return p.GetLogs(ctx, handle)
+}
+
+func (r *providerRegistry) TaskStatus(ctx context.Context, handle *taskHandle) (TaskPhase, error) {
+	p, err := r.get(handle)
+	if err != nil {
+		return "", err
+	}
+	return p.TaskStatus(ctx, handle)
+}
+
+func (r *providerRegistry) StopTask(ctx context.Context, handle *taskHandle) error {
+	p, err := r.get(handle)
+	if err != nil {
+		return err
+	}
+	return p.StopTask(ctx, handle)
+}
+
+func (r *providerRegistry) RemoveTask(ctx context.Context, handle *taskHandle) error {
+	p, err := r.get(handle)
+	if err != nil {
+		return err
+	}
+	if remover, ok := p.(taskRemover); ok {
+		return remover.RemoveTask(ctx, handle)
+	}
+	return nil
+}
+
+func (r *providerRegistry) StreamLogs(ctx context.Context, handle *taskHandle, w io.Writer) error {
+	p, err := r.get(handle)
+	if err != nil {
+		return err
+	}
+	streamer, ok := p.(logStreamer)
+	if !ok {
+		return errStreamLogsNotSupported
+	}
+	return streamer.StreamLogs(ctx, handle, w)
+}
+
+func (r *providerRegistry) GetStdLogs(ctx context.Context, handle *taskHandle) (string, string, error) {
+	p, err := r.get(handle)
+	if err != nil {
+		return "", "", err
+	}
+	getter, ok := p.(stdLogsGetter)
+	if !ok {
+		return "", "", errStdLogsNotSupported
+	}
+	return getter.GetStdLogs(ctx, handle)
+}
+
+// Ping checks that all the providers are reachable
+func (r *providerRegistry) Ping(ctx context.Context) error {
+	for _, name := range providerNames(r.providers) {
+		p, ok := r.providers[name].(pinger)
+		if !ok {
+			continue
+		}
+		if err := p.Ping(ctx); err != nil {
+			return fmt.Errorf("provider %s is not reachable: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (r *providerRegistry) ExitCode(ctx context.Context, handle *taskHandle) (int, bool, error) {
+	p, err := r.get(handle)
+	if err != nil {
+		return 0, false, err
+	}
+	getter, ok := p.(exitCodeGetter)
+	if !ok {
+		return 0, false, errExitCodeNotSupported
+	}
+	return getter.ExitCode(ctx, handle)
+}
+
+// ListOrphanedTasks lists the orphaned tasks of all the providers that can
+// list them
+func (r *providerRegistry) ListOrphanedTasks(ctx context.Context, currentRunId string) ([]*taskHandle, error) {
+	handles := []*taskHandle{}
+	for _, name := range providerNames(r.providers) {
+		lister, ok := r.providers[name].(orphanLister)
+		if !ok {
+			continue
+		}
+		orphans, err := lister.ListOrphanedTasks(ctx, currentRunId)
+		if err != nil {
+			return nil, fmt.Errorf("provider %s: %w", name, err)
+		}
+		for _, handle := range orphans {
+			handle.Provider = name
+		}
+		handles = append(handles, orphans...)
+	}
+	return handles, nil
+}
@@ -0,0 +1,90 @@
+package sparkanywhere
+
+import (
+	"log/slog"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+var defaultReconcileInterval = 10 * time.Second
+
+// runReconciler updates the phase of the pods with the status of their
+// tasks until the K8S is closed
+func (k *K8S) runReconciler() {
+	defer k.reconcilerWg.Done()
+
+	interval := k.config.ReconcileInterval
+	if interval == 0 {
+		interval = defaultReconcileInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-k.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		k.reconcilePods()
+	}
+}
+
+// reconcilePods queries the status of the tasks and emits a MODIFIED event
+// for the pods whose phase changed. Only the pending and running phases are
+// applied, the terminal ones are left to watchTask since it may restart the
+// task (see RestartPolicy) and it always sets them once WaitForTask returns.
+func (k *K8S) reconcilePods() {
+	// only the tasks of the current pods (i.e. not the driver)
+	k.createLock.Lock()
+	podKeys := map[string]struct{}{}
+	for _, pod := range k.listPods("") {
+		podKeys[pod.ObjectMeta.Namespace+"/"+pod.ObjectMeta.Name] = struct{}{}
+	}
+	k.createLock.Unlock()
+
+	phases := map[string]v1.PodPhase{}
+	for _, handle := range k.getHandles() {
+		key := handle.Namespace + "/" + handle.Name
+		if _, ok := podKeys[key]; !ok {
+			continue
+		}
+
+		// watchTask handles the tasks that exited (i.e. it may restart them)
+		k.handlesLock.Lock()
+		stopped := !handle.StoppedAt.IsZero()
+		k.handlesLock.Unlock()
+		if stopped {
+			continue
+		}
+		if k.ctx.Err() != nil {
+			return
+		}
+		phase, err := k.provider.TaskStatus(k.ctx, handle)
+		if err != nil {
+			slog.Debug("failed to get task status", "name", handle.Name, "err", err)
+			continue
+		}
+		if phase != TaskPending && phase != TaskRunning {
+			continue
+		}
+		phases[key] = v1.PodPhase(phase)
+	}
+
+	k.createLock.Lock()
+	defer k.createLock.Unlock()
+
+	for _, pod := range k.listPods("") {
+		phase, ok := phases[pod.ObjectMeta.Namespace+"/"+pod.ObjectMeta.Name]
+		if !ok || phase == pod.Status.Phase {
+			continue
+		}
+		// a terminated pod does not change its phase
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		pod.Status.Phase = phase
+		k.emitEvent("MODIFIED", pod)
+	}
+}
@@ -0,0 +1,54 @@
+package sparkanywhere
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+
+	"github.com/labstack/echo"
+)
+
+// requestIdHeader is the header with the id of an API request. The id of the
+// client is kept if it sets one, otherwise a new one is generated.
+const requestIdHeader = "X-Request-Id"
+
+// requestIdKey is the key of the request id in the echo context
+const requestIdKey = "requestId"
+
+func newRequestId() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(buf)
+}
+
+// requestIdMiddleware assigns an id to every request and returns it in the
+// response so that a request can be correlated with its tasks and logs
+func requestIdMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := c.Request().Header.Get(requestIdHeader)
+		if id == "" {
+			id = newRequestId()
+		}
+		c.Set(requestIdKey, id)
+		c.Response().Header().Set(requestIdHeader, id)
+		return next(c)
+	}
+}
+
+// requestId returns the id of the request
+func requestId(c echo.Context) string {
+	id, _ := c.Get(requestIdKey).(string)
+	return id
+}
+
+// taskLogger returns the logger of the provider with the name and the
+// request id of the task
+func taskLogger(logger *slog.Logger, task *Task) *slog.Logger {
+	logger = logger.With("task", task.Name)
+	if task.RequestId != "" {
+		logger = logger.With("request-id", task.RequestId)
+	}
+	return logger
+}
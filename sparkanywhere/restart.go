@@ -0,0 +1,111 @@
+package sparkanywhere
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+)
+
+// RestartPolicy relaunches the executor tasks that fail unexpectedly (i.e.
+// a Fargate Spot task reclaimed or an OOM kill) before their pod is failed
+type RestartPolicy struct {
+	// MaxRestarts is the number of times the task of a pod is relaunched.
+	// Zero disables the restarts.
+	MaxRestarts int `json:"maxRestarts,omitempty"`
+
+	// Backoff is the wait before the first restart, it doubles on every
+	// restart of the same pod up to 5 minutes (default: 10s)
+	Backoff time.Duration `json:"backoff,omitempty"`
+}
+
+var (
+	defaultRestartBackoff = 10 * time.Second
+	maxRestartBackoff     = 5 * time.Minute
+)
+
+// backoff returns the wait before the restart number restarts (zero based)
+func (r RestartPolicy) backoff(restarts int) time.Duration {
+	backoff := r.Backoff
+	if backoff <= 0 {
+		backoff = defaultRestartBackoff
+	}
+	for i := 0; i < restarts && backoff < maxRestartBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxRestartBackoff)
+}
+
+// restartTask relaunches the failed task of a pod with the same task spec if
+// the restart policy allows it and the pod still runs. It returns false if
+// the task was not restarted and the pod has to be failed.
+func (k *K8S) restartTask(handle *taskHandle, taskErr error) bool {
+	policy := k.config.RestartPolicy
+	if handle.task == nil || handle.Restarts >= policy.MaxRestarts || k.stopping.Load() {
+		return false
+	}
+
+	// the pod is deleted (i.e. Spark removed the executor) or it failed
+	// for another reason (i.e. max runtime exceeded)
+	running := func() bool {
+		k.createLock.Lock()
+		defer k.createLock.Unlock()
+
+		pod := k.findPod(handle.Namespace, handle.Name)
+		return pod != nil && pod.Status.Phase != v1.PodSucceeded && pod.Status.Phase != v1.PodFailed
+	}
+	if !running() {
+		return false
+	}
+
+	backoff := policy.backoff(handle.Restarts)
+	slog.Warn("task failed, restarting it", "name", handle.Name, "id", handle.ShortId, "restarts", handle.Restarts, "backoff", backoff, "err", taskErr)
+
+	select {
+	case <-time.After(backoff):
+	case <-k.ctx.Done():
+		return true
+	}
+	if !running() || k.stopping.Load() {
+		return false
+	}
+
+	start := time.Now()
+	ctx := trace.ContextWithSpanContext(k.ctx, handle.spanCtx)
+	restarted, err := k.createTask(ctx, handle.task, func(restarted *taskHandle) {
+		restarted.Name = handle.Name
+		restarted.Namespace = handle.Namespace
+		restarted.RequestId = handle.RequestId
+		restarted.Restarts = handle.Restarts + 1
+		restarted.task = handle.task
+		restarted.spanCtx = handle.spanCtx
+	})
+	if errors.Is(err, errStopping) {
+		return false
+	}
+	if err != nil {
+		k.metrics.taskCreateFailed()
+		slog.Error("failed to restart task", "name", handle.Name, "err", err)
+		return false
+	}
+	k.metrics.taskCreated(time.Since(start))
+
+	slog.Info("task restarted", "name", restarted.Name, "id", restarted.ShortId, "restarts", restarted.Restarts)
+
+	if !running() {
+		slog.Info("pod deleted while its task was restarted, stopping it", "name", restarted.Name, "id", restarted.ShortId)
+		if err := k.provider.StopTask(k.ctx, restarted); err != nil {
+			slog.Error("failed to stop task", "name", restarted.Name, "err", err)
+		}
+		return true
+	}
+
+	if k.config.MaxTaskRuntime != 0 {
+		go k.enforceMaxRuntime(restarted)
+	}
+	go k.watchTask(restarted)
+
+	return true
+}
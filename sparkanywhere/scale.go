@@ -0,0 +1,157 @@
+package sparkanywhere
+
+import (
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// scaledExecutorIdBase is the first id of the executors created by a scale
+// request, far from the ids that Spark assigns so that they do not collide
+var scaledExecutorIdBase = 10000
+
+type scaleRequest struct {
+	// App is the spark-app-selector of the application to scale. It can be
+	// empty if only one application is running.
+	App string `json:"app,omitempty"`
+
+	// Executors is the desired number of running executors
+	Executors int `json:"executors"`
+}
+
+type scaleResponse struct {
+	App       string `json:"app"`
+	Executors int    `json:"executors"`
+	Created   int    `json:"created"`
+	Stopped   int    `json:"stopped"`
+}
+
+// scaleExecutors creates or stops executor tasks of an application until the
+// number of running executors matches the requested one. The new executors
+// are copies of the last one with a new id. Spark is not aware of the change
+// and, without dynamic allocation, it replaces the executors that are stopped.
+func (k *K8S) scaleExecutors(c echo.Context) error {
+	var req scaleRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	if req.Executors < 0 {
+		return statusError(c, http.StatusBadRequest, metav1.StatusReasonBadRequest, "the number of executors cannot be negative")
+	}
+
+	k.createLock.Lock()
+
+	apps := map[string]struct{}{}
+	executors := []v1.Pod{}
+	for _, pod := range k.listPods("") {
+		if pod.ObjectMeta.Labels["spark-role"] != "executor" || pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		app := pod.ObjectMeta.Labels["spark-app-selector"]
+		apps[app] = struct{}{}
+		if req.App == "" || req.App == app {
+			executors = append(executors, *pod.DeepCopy())
+		}
+	}
+	if req.App == "" {
+		if len(apps) > 1 {
+			k.createLock.Unlock()
+			return statusError(c, http.StatusBadRequest, metav1.StatusReasonBadRequest, "more than one application is running, set the app to scale")
+		}
+		for app := range apps {
+			req.App = app
+		}
+	}
+	if len(executors) == 0 && req.Executors != 0 {
+		k.createLock.Unlock()
+		return statusError(c, http.StatusConflict, metav1.StatusReasonConflict, "there are no running executors to scale")
+	}
+
+	sort.Slice(executors, func(i, j int) bool {
+		return executorId(executors[i]) < executorId(executors[j])
+	})
+
+	res := scaleResponse{App: req.App, Executors: req.Executors}
+
+	// stop the newest executors first
+	stopped := []*taskHandle{}
+	for i := len(executors) - 1; i >= req.Executors; i-- {
+		namespace, name := executors[i].ObjectMeta.Namespace, executors[i].ObjectMeta.Name
+		k.removePod(namespace, name)
+		if handle := k.findHandle(namespace, name); handle != nil {
+			stopped = append(stopped, handle)
+		}
+		res.Stopped++
+	}
+
+	created := []v1.Pod{}
+	if len(executors) < req.Executors {
+		template := executors[len(executors)-1]
+		nextId := executorId(template) + 1
+		if nextId < scaledExecutorIdBase {
+			nextId = scaledExecutorIdBase
+		}
+		for i := len(executors); i < req.Executors; i++ {
+			created = append(created, cloneExecutorPod(template, nextId))
+			nextId++
+		}
+		res.Created = len(created)
+	}
+	k.createLock.Unlock()
+
+	for _, handle := range stopped {
+		if err := k.provider.StopTask(c.Request().Context(), handle); err != nil {
+			slog.Error("failed to stop task", "name", handle.Name, "err", err)
+		}
+	}
+	for _, pod := range created {
+		if _, err := k.addPendingPod(pod); err != nil {
+			slog.Error("error creating pod", "name", pod.ObjectMeta.Name, "request-id", requestId(c), "err", err)
+			continue
+		}
+		go k.createPodAsync(pod, requestId(c))
+	}
+
+	slog.Info("scaled executors", "request-id", requestId(c), "app", res.App, "executors", res.Executors, "created", res.Created, "stopped", res.Stopped)
+	return c.JSON(http.StatusOK, res)
+}
+
+// executorId returns the spark id of an executor pod
+func executorId(pod v1.Pod) int {
+	id, _ := strconv.Atoi(pod.ObjectMeta.Labels["spark-exec-id"])
+	return id
+}
+
+// cloneExecutorPod returns a copy of the executor pod with a new id
+func cloneExecutorPod(template v1.Pod, id int) v1.Pod {
+	pod := *template.DeepCopy()
+
+	oldId := strconv.Itoa(executorId(template))
+	newId := strconv.Itoa(id)
+
+	pod.ObjectMeta.Name = strings.TrimSuffix(template.ObjectMeta.Name, "-exec-"+oldId) + "-exec-" + newId
+	pod.ObjectMeta.Labels["spark-exec-id"] = newId
+	pod.ObjectMeta.ResourceVersion = ""
+	pod.ObjectMeta.DeletionTimestamp = nil
+	pod.ObjectMeta.CreationTimestamp = metav1.Now()
+	pod.Status = v1.PodStatus{}
+
+	for i := range pod.Spec.Containers {
+		for j, env := range pod.Spec.Containers[i].Env {
+			switch env.Name {
+			case "SPARK_EXECUTOR_ID":
+				pod.Spec.Containers[i].Env[j].Value = newId
+			case "SPARK_EXECUTOR_POD_NAME":
+				pod.Spec.Containers[i].Env[j].Value = pod.ObjectMeta.Name
+				pod.Spec.Containers[i].Env[j].ValueFrom = nil
+			}
+		}
+	}
+	return pod
+}
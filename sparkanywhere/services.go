@@ -0,0 +1,107 @@
+package sparkanywhere
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/labstack/echo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// The services are only stored to resolve the hostnames of the pods they
+// select (i.e. the driver service of the cluster deploy mode). There is no
+// load balancing, the names of the service are aliases of the task.
+
+func (k *K8S) postServices(c echo.Context) error {
+	var service v1.Service
+	if err := c.Bind(&service); err != nil {
+		return err
+	}
+	if service.ObjectMeta.Name == "" {
+		return statusError(c, http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "the name of the service is required")
+	}
+	service.ObjectMeta.Namespace = c.Param("namespace")
+	service.ObjectMeta.CreationTimestamp = metav1.Now()
+
+	key := service.ObjectMeta.Namespace + "/" + service.ObjectMeta.Name
+
+	k.servicesLock.Lock()
+	defer k.servicesLock.Unlock()
+
+	if _, ok := k.services[key]; ok {
+		return statusError(c, http.StatusConflict, metav1.StatusReasonAlreadyExists, fmt.Sprintf("services \"%s\" already exists", service.ObjectMeta.Name))
+	}
+	k.services[key] = service
+
+	return c.JSON(http.StatusCreated, service)
+}
+
+// patchService handles the server-side apply requests on services
+func (k *K8S) patchService(c echo.Context) error {
+	var service v1.Service
+	if ok, err := bindApplyPatch(c, &service.ObjectMeta, &service); !ok {
+		return err
+	}
+
+	key := service.ObjectMeta.Namespace + "/" + service.ObjectMeta.Name
+
+	k.servicesLock.Lock()
+	defer k.servicesLock.Unlock()
+
+	if existing, ok := k.services[key]; ok {
+		service.ObjectMeta.CreationTimestamp = existing.ObjectMeta.CreationTimestamp
+	} else {
+		service.ObjectMeta.CreationTimestamp = metav1.Now()
+	}
+	k.services[key] = service
+
+	return c.JSON(http.StatusOK, service)
+}
+
+// deleteServices removes the services that match the label selector.
+// Spark calls it at the end of the job.
+func (k *K8S) deleteServices(c echo.Context) error {
+	selector, err := labels.Parse(c.QueryParam("labelSelector"))
+	if err != nil {
+		return statusError(c, http.StatusBadRequest, metav1.StatusReasonBadRequest, err.Error())
+	}
+	namespace := c.Param("namespace")
+
+	k.servicesLock.Lock()
+	for key, service := range k.services {
+		if service.ObjectMeta.Namespace == namespace && selector.Matches(labels.Set(service.ObjectMeta.Labels)) {
+			delete(k.services, key)
+		}
+	}
+	k.servicesLock.Unlock()
+
+	return c.NoContent(http.StatusOK)
+}
+
+// podAliases returns the hostnames of the services that select the pod
+func (k *K8S) podAliases(pod v1.Pod) []string {
+	k.servicesLock.Lock()
+	defer k.servicesLock.Unlock()
+
+	aliases := []string{}
+	for _, service := range k.services {
+		if service.ObjectMeta.Namespace != pod.ObjectMeta.Namespace || len(service.Spec.Selector) == 0 {
+			continue
+		}
+		if !labels.SelectorFromSet(service.Spec.Selector).Matches(labels.Set(pod.ObjectMeta.Labels)) {
+			continue
+		}
+		name, namespace := service.ObjectMeta.Name, service.ObjectMeta.Namespace
+		aliases = append(aliases,
+			name,
+			name+"."+namespace,
+			name+"."+namespace+".svc",
+			name+"."+namespace+".svc.cluster.local",
+		)
+	}
+	sort.Strings(aliases)
+	return aliases
+}
@@ -0,0 +1,106 @@
+package sparkanywhere
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var defaultShutdownGracePeriod = 30 * time.Second
+
+// errStopping is returned when a task is created after StopTasks is called
+var errStopping = errors.New("tasks are being stopped")
+
+// createTask creates the task in the provider and tracks its handle, unless
+// the tasks are being stopped. init sets the fields of the handle before it
+// is tracked, so that StopTasks finds every task created before it returns.
+func (k *K8S) createTask(ctx context.Context, task *Task, init func(handle *taskHandle)) (*taskHandle, error) {
+	k.stopLock.Lock()
+	if k.stopping.Load() {
+		k.stopLock.Unlock()
+		return nil, errStopping
+	}
+	k.creates.Add(1)
+	k.stopLock.Unlock()
+	defer k.creates.Done()
+
+	handle, err := k.provider.CreateTask(ctx, task)
+	if err != nil {
+		return nil, err
+	}
+	init(handle)
+	if handle.StartedAt.IsZero() {
+		handle.StartedAt = time.Now()
+	}
+	k.addHandle(handle)
+	return handle, nil
+}
+
+// StopTasks stops the tasks that are still running (i.e. the run was
+// interrupted) so that they are not left behind in the providers. The job
+// queue and the task creations are stopped first. It waits
+// for at most ShutdownGracePeriod and it returns the tasks that could not be
+// stopped in the error.
+func (k *K8S) StopTasks() error {
+	grace := k.config.ShutdownGracePeriod
+	if grace <= 0 {
+		grace = defaultShutdownGracePeriod
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	// no more jobs are deployed and no more tasks are created, the
+	// creations in flight are waited for so that their tasks are stopped
+	k.stopLock.Lock()
+	k.stopping.Store(true)
+	k.stopLock.Unlock()
+	k.jobs.stop()
+
+	createsCh := make(chan struct{})
+	go func() {
+		k.creates.Wait()
+		close(createsCh)
+	}()
+	select {
+	case <-createsCh:
+	case <-ctx.Done():
+		slog.Warn("tasks still being created after the grace period")
+	}
+
+	running := []*taskHandle{}
+	k.handlesLock.Lock()
+	for _, handle := range k.handles {
+		if handle.StoppedAt.IsZero() {
+			running = append(running, handle)
+		}
+	}
+	k.handlesLock.Unlock()
+
+	if len(running) == 0 {
+		return nil
+	}
+	slog.Info("Stopping running tasks...", "count", len(running), "grace-period", grace)
+
+	errs := make([]error, len(running))
+
+	var wg sync.WaitGroup
+	for i, handle := range running {
+		wg.Add(1)
+		go func(i int, handle *taskHandle) {
+			defer wg.Done()
+
+			if err := k.provider.StopTask(ctx, handle); err != nil {
+				errs[i] = fmt.Errorf("%s (%s): %w", handle.Name, handle.ShortId, err)
+			}
+		}(i, handle)
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("failed to stop the tasks: %w", err)
+	}
+	return nil
+}
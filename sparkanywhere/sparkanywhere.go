@@ -1,23 +1,51 @@
 package sparkanywhere
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/labstack/echo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
 )
 
 type K8S struct {
-	config   *Config
-	pods     []v1.Pod
+	config *Config
+	runId  string
+
+	// defaultProvider is the name of the provider of the driver
+	defaultProvider string
+
+	// pods are the stored pods by namespace and name
+	pods     map[string]map[string]*v1.Pod
 	handles  []*taskHandle
 	updateCh []chan Event
 
@@ -25,151 +53,808 @@ type K8S struct {
 
 	createLock      sync.Mutex
 	resourceVersion uint64
+
+	// events is the log of the last events by resource version
+	events []eventEntry
+
+	handlesLock sync.Mutex
+
+	// configMaps are the stored config maps by namespace/name
+	configMaps     map[string]v1.ConfigMap
+	configMapsLock sync.Mutex
+
+	// services are the stored services by namespace/name
+	services     map[string]v1.Service
+	servicesLock sync.Mutex
+
+	// deploySpans are the span contexts of the running deploys by app
+	// name, the spans of the tasks of each app are their children
+	deploySpans     map[string]trace.SpanContext
+	deploySpansLock sync.Mutex
+
+	jobs *jobQueue
+
+	// createSem limits the concurrent task creations, nil if unlimited
+	createSem chan struct{}
+
+	// stopping is set once the tasks are stopped on shutdown so that no
+	// more tasks are created or restarted. creates tracks the in-flight
+	// creations, stopLock orders them with the start of the shutdown.
+	stopping atomic.Bool
+	stopLock sync.Mutex
+	creates  sync.WaitGroup
+
+	metrics *metrics
+
+	// ctx is cancelled on Close to abort any in-flight provider call
+	ctx      context.Context
+	cancelFn context.CancelFunc
+
+	// reconcilerWg waits for the reconciler to stop on Close
+	reconcilerWg sync.WaitGroup
+
+	// server is the control plane API server, it is stopped on Close
+	server *echo.Echo
+
+	// tracingShutdownFn flushes the pending spans if tracing is enabled
+	tracingShutdownFn func(context.Context) error
 }
 
 type Config struct {
-	ControlPlaneAddr string
-	EcsEnabled       bool
-	DockerEnabled    bool
-	EcsConfig        *ECSConfig
-	Instances        uint64
+	ControlPlaneAddr  string            `json:"controlPlaneAddr,omitempty"`
+	EcsEnabled        bool              `json:"ecsEnabled,omitempty"`
+	DockerEnabled     bool              `json:"dockerEnabled,omitempty"`
+	KubernetesEnabled bool              `json:"kubernetesEnabled,omitempty"`
+	NomadEnabled      bool              `json:"nomadEnabled,omitempty"`
+	LocalEnabled      bool              `json:"localEnabled,omitempty"`
+	EcsConfig         *ECSConfig        `json:"ecsConfig,omitempty"`
+	DockerConfig      *DockerConfig     `json:"dockerConfig,omitempty"`
+	KubernetesConfig  *KubernetesConfig `json:"kubernetesConfig,omitempty"`
+	NomadConfig       *NomadConfig      `json:"nomadConfig,omitempty"`
+	Instances         uint64            `json:"instances,omitempty"`
+
+	// DryRun logs the tasks instead of creating them in the providers
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// FakeProvider runs the tasks in an in-memory provider (named fake),
+	// it is meant for testing the control plane
+	FakeProvider *FakeProvider `json:"-"`
+
+	// ListenAddr and Port are the address where the control plane API
+	// listens. Empty listens on all the interfaces and the default port
+	// is 1323. The tasks reach it on ControlPlaneAddr and Port.
+	ListenAddr string `json:"listenAddr,omitempty"`
+	Port       int    `json:"port,omitempty"`
+
+	// TLSCertFile and TLSKeyFile serve the control plane API over HTTPS
+	// if both are set
+	TLSCertFile string `json:"tlsCertFile,omitempty"`
+	TLSKeyFile  string `json:"tlsKeyFile,omitempty"`
+
+	// AuthToken is the bearer token required by the control plane API
+	AuthToken string `json:"authToken,omitempty"`
+
+	// Namespaces are the namespaces accepted by the control plane API. Any
+	// namespace is accepted if empty. The jobs are submitted to the first one
+	// unless spark.kubernetes.namespace is set.
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// DefaultProvider is the provider used for the driver and for the pods
+	// without the sparkanywhere.io/provider annotation. It is required if
+	// more than one provider is enabled.
+	DefaultProvider string `json:"defaultProvider,omitempty"`
+
+	// LocalDirsPath is the path that SPARK_LOCAL_DIRS is remapped to in the
+	// executor tasks. Spark points it to a directory inside the image, which
+	// is not writable when the task runs with a read-only root filesystem.
+	// Defaults to /tmp.
+	LocalDirsPath string `json:"localDirsPath,omitempty"`
+
+	// DisableLocalDirsRemap leaves SPARK_LOCAL_DIRS untouched. Use it when the
+	// image already provides a writable scratch volume for Spark.
+	DisableLocalDirsRemap bool `json:"disableLocalDirsRemap,omitempty"`
+
+	// SparkConf are extra --conf entries for spark-submit. They take
+	// precedence over the ones in PropertiesFile.
+	SparkConf map[string]string `json:"sparkConf,omitempty"`
+
+	// GlobalEnv are environment variables set in every task (i.e. proxy
+	// settings). The env of the pods takes precedence over them.
+	GlobalEnv map[string]string `json:"globalEnv,omitempty"`
+
+	// SparkJob is the application submitted by the jobs. The SparkPi
+	// example is used for the fields that are not set.
+	SparkJob SparkJob `json:"sparkJob,omitempty"`
+
+	// Jobs are the Spark jobs to submit. If empty, it submits SparkJob once.
+	Jobs []*JobSpec `json:"jobs,omitempty"`
+
+	// DeployMode is the spark-submit deploy mode, client (default) or
+	// cluster. In cluster mode the driver runs as a task too.
+	DeployMode string `json:"deployMode,omitempty"`
+
+	// JobConcurrency is the maximum number of jobs running at the same time.
+	// Zero means no limit.
+	JobConcurrency int `json:"jobConcurrency,omitempty"`
+
+	// PropertiesFile is a spark-defaults.conf style file with --conf entries
+	// for spark-submit.
+	PropertiesFile string `json:"propertiesFile,omitempty"`
+
+	// RunAsUser is the default UID[:GID] the tasks run as. It is overridden
+	// by the securityContext of the pod.
+	RunAsUser string `json:"runAsUser,omitempty"`
+
+	// DNSServers are the DNS servers of the tasks. Not every provider can set
+	// them per task (i.e. ECS), see the README for details.
+	DNSServers []string `json:"dnsServers,omitempty"`
+
+	// MaxTaskRuntime is the maximum time an executor task can run before it
+	// is stopped and its pod marked as failed. Zero disables the limit.
+	MaxTaskRuntime time.Duration `json:"maxTaskRuntime,omitempty"`
+
+	// LogDir is the directory where the logs of every run are written to
+	// a subdirectory named after the time of the run (default: logs)
+	LogDir string `json:"logDir,omitempty"`
+
+	// LogRetentionCount is the number of run log directories to keep.
+	// Zero keeps all of them.
+	LogRetentionCount int `json:"logRetentionCount,omitempty"`
+
+	// LogRetentionAge is the maximum age of the run log directories to keep.
+	// Zero keeps all of them.
+	LogRetentionAge time.Duration `json:"logRetentionAge,omitempty"`
+
+	// TracingEndpoint is the host:port of the OTLP HTTP collector to export
+	// the traces of the job. Tracing is disabled if empty.
+	TracingEndpoint string `json:"tracingEndpoint,omitempty"`
+	TracingInsecure bool   `json:"tracingInsecure,omitempty"`
+
+	// StreamLogs tails the logs of the driver tasks to stdout while they run
+	StreamLogs bool `json:"streamLogs,omitempty"`
+
+	// SummaryFile is the path to write the JSON summary of the run to when
+	// the logs are gathered. It is not written if empty.
+	SummaryFile string `json:"summaryFile,omitempty"`
+
+	// MetricsEnabled exposes the Prometheus metrics in GET /metrics
+	MetricsEnabled bool `json:"metricsEnabled,omitempty"`
+
+	// MaxConcurrentCreates is the maximum number of tasks being created in
+	// the providers at the same time, the rest wait for their turn. Zero
+	// means no limit.
+	MaxConcurrentCreates int `json:"maxConcurrentCreates,omitempty"`
+
+	// RestartPolicy restarts the executor tasks that fail unexpectedly
+	RestartPolicy RestartPolicy `json:"restartPolicy,omitempty"`
+
+	// ShutdownGracePeriod bounds how long the tasks that are still running
+	// take to stop on shutdown (default: 30s)
+	ShutdownGracePeriod time.Duration `json:"shutdownGracePeriod,omitempty"`
+
+	// CleanupOrphans stops and removes the tasks left behind by other runs
+	// (i.e. a crashed run) before the jobs start. It must not be used while
+	// other runs share the providers.
+	CleanupOrphans bool `json:"cleanupOrphans,omitempty"`
+
+	// ReconcileInterval is how often the phase of the pods is synced with
+	// the status of their tasks (default: 10s)
+	ReconcileInterval time.Duration `json:"reconcileInterval,omitempty"`
 }
 
+var defaultLocalDirsPath = "/tmp"
+
+var defaultLogDir = "logs"
+
+var runAsUserRegexp = regexp.MustCompile(`^[0-9]+(:[0-9]+)?$`)
+
+var hostnameRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*$`)
+
 func New(config *Config) (*K8S, error) {
-	if config.EcsEnabled && config.DockerEnabled {
-		return nil, fmt.Errorf("only one provider can be enabled")
+	if config.LocalDirsPath == "" {
+		config.LocalDirsPath = defaultLocalDirsPath
+	}
+	if config.LogDir == "" {
+		config.LogDir = defaultLogDir
+	}
+	// the provider configs are optional for the library users
+	if config.DockerConfig == nil {
+		config.DockerConfig = &DockerConfig{}
+	}
+	if config.EcsConfig == nil {
+		config.EcsConfig = &ECSConfig{}
+	}
+	if config.KubernetesConfig == nil {
+		config.KubernetesConfig = &KubernetesConfig{}
+	}
+	if config.NomadConfig == nil {
+		config.NomadConfig = &NomadConfig{}
+	}
+	if config.RunAsUser != "" && !runAsUserRegexp.MatchString(config.RunAsUser) {
+		return nil, fmt.Errorf("invalid run as user '%s', expected UID[:GID]", config.RunAsUser)
+	}
+	switch config.DeployMode {
+	case "":
+		config.DeployMode = deployModeClient
+	case deployModeClient, deployModeCluster:
+	default:
+		return nil, fmt.Errorf("invalid deploy mode '%s', expected %s or %s", config.DeployMode, deployModeClient, deployModeCluster)
+	}
+	if config.DeployMode == deployModeCluster && config.AuthToken != "" {
+		// spark hands the token to the driver with a secret, which is not supported
+		return nil, fmt.Errorf("the auth token is not supported in the cluster deploy mode")
+	}
+
+	sparkConf := map[string]string{}
+	if config.PropertiesFile != "" {
+		props, err := readPropertiesFile(config.PropertiesFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read properties file: %w", err)
+		}
+		sparkConf = props
+	}
+	for key, value := range config.SparkConf {
+		sparkConf[key] = value
+	}
+	config.SparkConf = sparkConf
+
+	if !config.EcsEnabled && !config.DockerEnabled && !config.KubernetesEnabled && !config.NomadEnabled && !config.LocalEnabled && config.FakeProvider == nil {
+		return nil, fmt.Errorf("no provider selected, enable at least one of: %s", strings.Join(availableProviders, ", "))
 	}
 
-	var (
-		provider provider
-		err      error
-	)
+	providers := map[string]provider{}
 	if config.EcsEnabled {
-		provider, err = newEcsProvider(config.EcsConfig)
-	} else {
-		provider, err = newDockerProvider()
+		p, err := newEcsProvider(config.EcsConfig)
+		if err != nil {
+			return nil, err
+		}
+		providers["ecs"] = p
+	}
+	if config.KubernetesEnabled {
+		p, err := newKubernetesProvider(config.KubernetesConfig)
+		if err != nil {
+			return nil, err
+		}
+		providers["kubernetes"] = p
+	}
+	if config.NomadEnabled {
+		p, err := newNomadProvider(config.NomadConfig)
+		if err != nil {
+			return nil, err
+		}
+		providers["nomad"] = p
+	}
+	if config.LocalEnabled {
+		providers["local"] = newProcessProvider()
+	}
+	if config.FakeProvider != nil {
+		providers["fake"] = config.FakeProvider
+	}
+	if config.DockerEnabled {
+		p, err := newDockerProvider(config.DockerConfig)
+		if err != nil {
+			return nil, err
+		}
+		providers["docker"] = p
+	}
+	registry, err := newProviderRegistry(providers, config.DefaultProvider)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := config.Jobs
+	if len(jobs) == 0 {
+		name := "spark-pi"
+		if config.SparkJob.Application != "" {
+			name = "spark-app"
+		}
+		jobs = []*JobSpec{{Name: name}}
+	}
+	queue, err := newJobQueue(jobs, config.JobConcurrency)
+	if err != nil {
+		return nil, err
 	}
+
+	runId, err := newRunId()
 	if err != nil {
 		return nil, err
 	}
 
+	ctx, cancelFn := context.WithCancel(context.Background())
+
 	k := &K8S{
-		config:   config,
-		handles:  []*taskHandle{},
-		provider: provider,
+		config:          config,
+		runId:           runId,
+		defaultProvider: registry.defaultName,
+		pods:            map[string]map[string]*v1.Pod{},
+		handles:         []*taskHandle{},
+		configMaps:      map[string]v1.ConfigMap{},
+		services:        map[string]v1.Service{},
+		deploySpans:     map[string]trace.SpanContext{},
+		provider:        registry,
+		jobs:            queue,
+		metrics:         newMetrics(),
+		ctx:             ctx,
+		cancelFn:        cancelFn,
+	}
+	if config.MaxConcurrentCreates > 0 {
+		k.createSem = make(chan struct{}, config.MaxConcurrentCreates)
+	}
+
+	if config.TracingEndpoint != "" {
+		if k.tracingShutdownFn, err = initTracing(ctx, config.TracingEndpoint, config.TracingInsecure); err != nil {
+			cancelFn()
+			return nil, err
+		}
+		k.provider = &tracedProvider{provider: registry}
 	}
 	return k, nil
 }
 
+// newRunId returns a random identifier for the run
+func newRunId() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// taskLabels returns the labels that identify the task of a pod in the provider
+func (k *K8S) taskLabels(appName, podName string) map[string]string {
+	return map[string]string{
+		labelRunId:   k.runId,
+		labelAppName: appName,
+		labelPodName: podName,
+	}
+}
+
 func (k *K8S) Run() error {
-	k.initServer()
-	return k.deploy()
+	if err := k.initServer(); err != nil {
+		return err
+	}
+
+	// a remote docker daemon reaches the control plane with the given address
+	if k.defaultProvider == "docker" && k.config.DockerConfig.Host == "" {
+		k.config.ControlPlaneAddr = "host.docker.internal"
+	}
+	// the local processes run in the same host
+	if k.defaultProvider == "local" && k.config.ControlPlaneAddr == "" {
+		k.config.ControlPlaneAddr = "localhost"
+	}
+	if k.config.ControlPlaneAddr == "" {
+		return fmt.Errorf("control plane public address is required")
+	}
+	controlPlaneAddr, err := normalizeControlPlaneAddr(k.config.ControlPlaneAddr)
+	if err != nil {
+		return err
+	}
+	k.config.ControlPlaneAddr = controlPlaneAddr
+
+	slog.Info("Using control plane address", "control-plane-addr", k.config.ControlPlaneAddr)
+
+	if k.config.CleanupOrphans {
+		if err := k.cleanupOrphans(k.ctx); err != nil {
+			return err
+		}
+	}
+
+	k.reconcilerWg.Add(1)
+	go k.runReconciler()
+
+	return k.jobs.run(k.ctx, k.deploy)
 }
 
 func (k *K8S) addHandle(handle *taskHandle) {
+	k.handlesLock.Lock()
+	defer k.handlesLock.Unlock()
+
 	k.handles = append(k.handles, handle)
 }
 
-func (k *K8S) GatherLogs() error {
+// getHandles returns a copy of the tracked handles
+func (k *K8S) getHandles() []*taskHandle {
+	k.handlesLock.Lock()
+	defer k.handlesLock.Unlock()
+
+	return append([]*taskHandle{}, k.handles...)
+}
+
+// findHandle returns the handle of the task of a pod, the last one if the
+// task was restarted
+func (k *K8S) findHandle(namespace, name string) *taskHandle {
+	k.handlesLock.Lock()
+	defer k.handlesLock.Unlock()
+
+	for i := len(k.handles) - 1; i >= 0; i-- {
+		if handle := k.handles[i]; handle.Namespace == namespace && handle.Name == name {
+			return handle
+		}
+	}
+	return nil
+}
+
+// gatherLogsWorkers is the number of tasks whose logs are fetched at the same time
+var gatherLogsWorkers = 8
+
+// GatherLogs writes the logs of all the tasks in a new directory under LogDir
+// and returns the summary of the run. The summary is also written as JSON to
+// SummaryFile if it is set. The logs are fetched concurrently, if some of them
+// cannot be fetched the summary is returned along with an error listing them.
+func (k *K8S) GatherLogs() (*RunSummary, error) {
 	slog.Info("Gathering logs...")
 
 	// create log directory
-	logDir := filepath.Join("logs", fmt.Sprintf("%d", time.Now().UTC().UnixMilli()))
+	logDir := filepath.Join(k.config.LogDir, fmt.Sprintf("%d", time.Now().UTC().UnixMilli()))
 	if err := os.MkdirAll(logDir, 0755); err != nil {
-		return err
+		return nil, err
+	}
+
+	handles := k.getHandles()
+	summary := &RunSummary{
+		RunId:  k.runId,
+		LogDir: logDir,
+		Tasks:  make([]TaskSummary, len(handles)),
+	}
+
+	// get logs from all the handles, each file is written as soon as its
+	// logs are fetched
+	logErrs := make([]error, len(handles))
+
+	indexCh := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < min(gatherLogsWorkers, len(handles)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for indx := range indexCh {
+				handle := handles[indx]
+
+				ctx := trace.ContextWithSpanContext(context.Background(), handle.spanCtx)
+
+				logFiles, err := k.writeTaskLogs(ctx, logDir, handle)
+				if err != nil {
+					slog.Warn("failed to get the logs of the task", "name", handle.Name, "err", err)
+					logErrs[indx] = fmt.Errorf("%s: %w", handle.Name, err)
+
+					if path, err := writeLogsError(logDir, handle, err); err != nil {
+						slog.Warn("failed to write the logs error", "name", handle.Name, "err", err)
+					} else {
+						logFiles = []string{path}
+					}
+				}
+				summary.Tasks[indx] = k.taskSummary(ctx, handle, logFiles)
+
+				// remove the finished tasks that the provider leaves behind
+				if remover, ok := k.provider.(taskRemover); ok {
+					if err := remover.RemoveTask(ctx, handle); err != nil {
+						slog.Warn("failed to remove task", "name", handle.Name, "err", err)
+					}
+				}
+			}
+		}()
+	}
+	for indx := range handles {
+		indexCh <- indx
 	}
+	close(indexCh)
+	wg.Wait()
 
-	// get logs from all the handles
-	for _, handle := range k.handles {
-		logs, err := k.provider.GetLogs(handle)
+	var failed []error
+	for _, err := range logErrs {
 		if err != nil {
-			return err
+			failed = append(failed, err)
 		}
+	}
 
-		// write logs to file
-		if err := os.WriteFile(filepath.Join(logDir, handle.Name+".log"), []byte(logs), 0644); err != nil {
-			return err
+	if k.config.SummaryFile != "" {
+		if err := writeSummary(k.config.SummaryFile, summary); err != nil {
+			return nil, fmt.Errorf("failed to write the run summary: %w", err)
 		}
 	}
 
-	return nil
+	// remove the logs from old runs
+	if err := pruneLogDirs(k.config.LogDir, logDir, k.config.LogRetentionCount, k.config.LogRetentionAge); err != nil {
+		return nil, err
+	}
+
+	if len(failed) != 0 {
+		return summary, fmt.Errorf("failed to get the logs of %d tasks: %w", len(failed), errors.Join(failed...))
+	}
+	return summary, nil
 }
 
-func (k *K8S) deploy() error {
-	if k.config.DockerEnabled {
-		k.config.ControlPlaneAddr = "host.docker.internal"
+const (
+	deployModeClient  = "client"
+	deployModeCluster = "cluster"
+)
+
+var (
+	defaultDriverPort             int32 = 7078
+	defaultDriverBlockManagerPort int32 = 7079
+)
+
+func (k *K8S) deploy(ctx context.Context, job *JobSpec) (err error) {
+	ctx, span := tracer.Start(ctx, "deploy", trace.WithAttributes(attribute.String("job.name", job.Name)))
+	defer func() { endSpan(span, err) }()
+
+	k.setDeploySpan(job.Name, span.SpanContext())
+	defer k.setDeploySpan(job.Name, trace.SpanContext{})
+
+	sparkJob := k.config.SparkJob.merge(job.SparkJob).withDefaults()
+
+	conf := map[string]string{
+		"spark.executor.instances":         strconv.Itoa(int(k.config.Instances)),
+		"spark.kubernetes.container.image": sparkJob.Image,
+
+		// fix the ports of the driver so that they can be exposed
+		"spark.driver.port":              strconv.Itoa(int(defaultDriverPort)),
+		"spark.driver.blockManager.port": strconv.Itoa(int(defaultDriverBlockManagerPort)),
 	}
-	if k.config.ControlPlaneAddr == "" {
-		return fmt.Errorf("control plane public address is required")
+	if k.config.AuthToken != "" {
+		conf["spark.kubernetes.authenticate.oauthToken"] = k.config.AuthToken
+	}
+	if len(k.config.Namespaces) != 0 {
+		conf["spark.kubernetes.namespace"] = k.config.Namespaces[0]
+	}
+	for key, value := range k.config.SparkConf {
+		conf[key] = value
+	}
+	for key, value := range job.Conf {
+		conf[key] = value
 	}
 
-	slog.Info("Using control plane address", "control-plane-addr", k.config.ControlPlaneAddr)
+	// there is no external shuffle service, dynamic allocation needs to
+	// track the shuffle files to remove the idle executors
+	if conf["spark.dynamicAllocation.enabled"] == "true" {
+		if _, ok := conf["spark.dynamicAllocation.shuffleTracking.enabled"]; !ok {
+			conf["spark.dynamicAllocation.shuffleTracking.enabled"] = "true"
+		}
+	}
+
+	confKeys := make([]string, 0, len(conf))
+	for key := range conf {
+		confKeys = append(confKeys, key)
+	}
+	sort.Strings(confKeys)
+
+	cmd := "cd .. && ./bin/spark-submit --master " + k.masterURL() + " --deploy-mode " + k.config.DeployMode + " --name " + job.Name
+	if sparkJob.isPython() {
+		if len(sparkJob.PyFiles) != 0 {
+			cmd += " --py-files " + shellQuote(strings.Join(sparkJob.PyFiles, ","))
+		}
+	} else if sparkJob.MainClass != "" {
+		cmd += " --class " + sparkJob.MainClass
+	}
+	for _, key := range confKeys {
+		cmd += " --conf " + shellQuote(key+"="+conf[key])
+	}
+	cmd += " " + shellQuote(sparkJob.Application)
+	for _, arg := range sparkJob.Args {
+		cmd += " " + shellQuote(arg)
+	}
 
 	task := &Task{
-		Name:  "spark-pi",
-		Image: "apache/spark",
+		Name:       job.Name,
+		Image:      sparkJob.Image,
+		User:       k.config.RunAsUser,
+		DNSServers: k.config.DNSServers,
+		Labels:     k.taskLabels(job.Name, job.Name),
+		Env:        k.globalEnv(),
 		Args: []string{
 			"/bin/bash",
 			"-c",
-			"cd .. && ./bin/spark-submit --master k8s://http://" + k.config.ControlPlaneAddr + ":1323 --deploy-mode client --name spark-pi --class org.apache.spark.examples.SparkPi --conf spark.executor.instances=" + strconv.Itoa(int(k.config.Instances)) + " --conf spark.kubernetes.container.image=apache/spark:latest ./examples/jars/spark-examples_2.12-3.5.0.jar",
+			cmd,
 		},
 	}
+	if k.config.DeployMode == deployModeClient {
+		// the executors connect back to the driver in this task
+		for _, key := range []string{"spark.driver.port", "spark.driver.blockManager.port"} {
+			if port, err := strconv.ParseInt(conf[key], 10, 32); err == nil && port > 0 {
+				task.Ports = append(task.Ports, int32(port))
+			}
+		}
+	}
+
+	if k.config.DryRun {
+		k.logDryRun(task)
+		return nil
+	}
 
-	handle, err := k.provider.CreateTask(task)
+	handle, err := k.createTask(ctx, task, func(handle *taskHandle) {
+		handle.Name = job.Name
+		handle.spanCtx = span.SpanContext()
+	})
 	if err != nil {
 		return err
 	}
 
-	handle.Name = "spark-pi"
-	k.addHandle(handle)
+	slog.Info("deploy task created", "name", handle.Name, "id", handle.ShortId)
 
-	slog.Info("deploy task created", "name", handle.Name, "id", handle.Id)
+	if k.config.StreamLogs {
+		streamCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
 
-	if err := k.provider.WaitForTask(handle); err != nil {
-		return err
+		// wait for the last lines of the driver before returning
+		doneCh := k.streamTaskLogs(streamCtx, handle)
+		defer func() {
+			select {
+			case <-doneCh:
+			case <-time.After(2 * logStreamInterval):
+			}
+		}()
 	}
 
-	return nil
+	err = k.provider.WaitForTask(ctx, handle)
+	if ctx.Err() == nil {
+		k.finishHandle(handle, err)
+	}
+	return err
+}
+
+// globalEnv returns a copy of the environment variables of every task
+func (k *K8S) globalEnv() map[string]string {
+	env := make(map[string]string, len(k.config.GlobalEnv))
+	for name, value := range k.config.GlobalEnv {
+		env[name] = value
+	}
+	return env
+}
+
+// shellQuote quotes s as a single argument of the /bin/bash -c command
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
 }
 
-func (k *K8S) initServer() {
+// normalizeControlPlaneAddr returns the host of the control plane address,
+// which can be given as a host, host:port or a full URL.
+func normalizeControlPlaneAddr(addr string) (string, error) {
+	host := strings.TrimSpace(addr)
+
+	if strings.Contains(host, "://") {
+		u, err := url.Parse(host)
+		if err != nil {
+			return "", fmt.Errorf("invalid control plane address '%s': %w", addr, err)
+		}
+		host = u.Hostname()
+	} else if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+
+	if net.ParseIP(host) == nil && !hostnameRegexp.MatchString(host) {
+		return "", fmt.Errorf("invalid control plane address '%s': not a valid host or ip", addr)
+	}
+	return host, nil
+}
+
+// defaultPort is the port of the control plane API if Port is not set
+var defaultPort = 1323
+
+// port is the port where the control plane API listens
+func (k *K8S) port() int {
+	if k.config.Port == 0 {
+		return defaultPort
+	}
+	return k.config.Port
+}
+
+// masterURL is the Spark master URL of the control plane
+func (k *K8S) masterURL() string {
+	scheme := "http"
+	if k.tlsEnabled() {
+		scheme = "https"
+	}
+	return "k8s://" + scheme + "://" + net.JoinHostPort(k.config.ControlPlaneAddr, strconv.Itoa(k.port()))
+}
+
+// initServer starts the control plane API server. The address is bound
+// before it returns so that a failure (i.e. the port is already in use) is
+// reported instead of deploying the job against a dead server.
+func (k *K8S) initServer() error {
 	e := echo.New()
 	e.HideBanner = true
+	k.server = e
 
 	logger := slog.With("theme", "k8s-server")
 
+	e.Use(requestIdMiddleware)
 	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
-			logger.Info("request", "method", c.Request().Method, "path", c.Path(), "query", c.QueryString())
+			logger.Info("request", "request-id", requestId(c), "method", c.Request().Method, "path", c.Path(), "query", c.QueryString())
+			return next(c)
+		}
+	})
+
+	if k.config.MetricsEnabled {
+		e.Use(k.metrics.middleware)
+	}
+
+	// recover from the panics in the handlers so that a bad request does
+	// not take down the control plane
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					logger.Error("panic handling request", "method", c.Request().Method, "path", c.Path(), "panic", r, "stack", string(debug.Stack()))
+					err = statusError(c, http.StatusInternalServerError, metav1.StatusReasonInternalError, fmt.Sprintf("internal error: %v", r))
+				}
+			}()
 			return next(c)
 		}
 	})
 
+	// require the bearer token on every route but the health checks and
+	// the version
+	if k.config.AuthToken != "" {
+		e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				if _, ok := unauthenticatedPaths[c.Request().URL.Path]; ok {
+					return next(c)
+				}
+				token := strings.TrimPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+				if subtle.ConstantTimeCompare([]byte(token), []byte(k.config.AuthToken)) != 1 {
+					return statusError(c, http.StatusUnauthorized, metav1.StatusReasonUnauthorized, "Unauthorized")
+				}
+				return next(c)
+			}
+		})
+	}
+
+	if k.config.MetricsEnabled {
+		e.GET("/metrics", k.getMetrics)
+	}
+
+	// the pods and config maps are stored by namespace, reject the ones
+	// that are not allowed
+	if len(k.config.Namespaces) != 0 {
+		e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				if namespace := c.Param("namespace"); namespace != "" && !slices.Contains(k.config.Namespaces, namespace) {
+					return statusError(c, http.StatusForbidden, metav1.StatusReasonForbidden, fmt.Sprintf("namespace \"%s\" is not allowed", namespace))
+				}
+				return next(c)
+			}
+		})
+	}
+
 	e.GET("/", func(c echo.Context) error {
 		return c.String(http.StatusOK, "Hello, World!")
 	})
+	e.GET("/healthz", k.getHealthz)
+	e.GET("/readyz", k.getReadyz)
+
+	e.GET("/logs/stream", k.streamLogs)
+	e.GET("/debug/stats", k.getStats)
+	e.POST("/scale", k.scaleExecutors)
+	e.GET("/tasks", k.getTasks)
+
+	// discovery
+	e.GET("/version", k.getVersion)
+	e.GET("/api", k.getAPIVersions)
+	e.GET("/apis", k.getAPIGroups)
+	e.GET("/api/v1", k.getAPIResources)
 
 	// pod namespace
 	e.GET("/api/v1/namespaces/:namespace/pods", k.getPods)
 	e.POST("/api/v1/namespaces/:namespace/pods", k.postPods)
-	e.DELETE("/api/v1/namespaces/:namespace/pods", func(c echo.Context) error {
-		// this one is called at the end of the spark job
-		return c.NoContent(http.StatusOK)
-	})
+	e.GET("/api/v1/namespaces/:namespace/pods/:name", k.getPod)
+	e.PATCH("/api/v1/namespaces/:namespace/pods/:name", k.patchPod)
+	e.POST("/api/v1/namespaces/:namespace/pods/:name/binding", k.postPodBinding)
+	e.DELETE("/api/v1/namespaces/:namespace/pods", k.deletePods)
+	e.DELETE("/api/v1/namespaces/:namespace/pods/:name", k.deletePod)
 
 	// config map namespace
 	e.POST("/api/v1/namespaces/:namespace/configmaps", k.postConfigMaps)
-	e.GET("/api/v1/namespaces/:namespace/configmaps", k.getConfigMap)
-	e.DELETE("/api/v1/namespaces/:namespace/configmaps", func(c echo.Context) error {
-		// this one is called at the end of the spark job
-		return c.NoContent(http.StatusOK)
-	})
+	e.GET("/api/v1/namespaces/:namespace/configmaps", k.getConfigMaps)
+	e.GET("/api/v1/namespaces/:namespace/configmaps/:name", k.getConfigMap)
+	e.PATCH("/api/v1/namespaces/:namespace/configmaps/:name", k.patchConfigMap)
+	e.DELETE("/api/v1/namespaces/:namespace/configmaps", k.deleteConfigMaps)
 
 	// services
-	e.DELETE("/api/v1/namespaces/:namespace/services", func(c echo.Context) error {
-		// this one is called at the end of the spark job
-		return c.NoContent(http.StatusOK)
-	})
+	e.POST("/api/v1/namespaces/:namespace/services", k.postServices)
+	e.PATCH("/api/v1/namespaces/:namespace/services/:name", k.patchService)
+	e.DELETE("/api/v1/namespaces/:namespace/services", k.deleteServices)
 
 	// persistent volume claims
 	e.DELETE("/api/v1/namespaces/:namespace/persistentvolumeclaims", func(c echo.Context) error {
@@ -177,9 +862,66 @@ func (k *K8S) initServer() {
 		return c.NoContent(http.StatusOK)
 	})
 
+	var tlsConfig *tls.Config
+	if k.tlsEnabled() {
+		cert, err := tls.LoadX509KeyPair(k.config.TLSCertFile, k.config.TLSKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load the TLS certificate: %w", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	addr := net.JoinHostPort(k.config.ListenAddr, strconv.Itoa(k.port()))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start the API server on %s: %w", addr, err)
+	}
+
 	go func() {
-		e.Start("0.0.0.0:1323")
+		var err error
+		if tlsConfig != nil {
+			e.TLSListener = tls.NewListener(listener, tlsConfig)
+			err = e.StartTLS(addr, k.config.TLSCertFile, k.config.TLSKeyFile)
+		} else {
+			e.Listener = listener
+			err = e.Start(addr)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error("API server failed", "err", err)
+		}
 	}()
+	return nil
+}
+
+// unauthenticatedPaths are the routes that do not require the auth token
+var unauthenticatedPaths = map[string]struct{}{
+	"/":        {},
+	"/healthz": {},
+	"/readyz":  {},
+	"/version": {},
+}
+
+// tlsEnabled returns true if the API server is served over HTTPS
+func (k *K8S) tlsEnabled() bool {
+	return k.config.TLSCertFile != "" && k.config.TLSKeyFile != ""
+}
+
+func (k *K8S) getStats(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"jobs": k.jobs.Stats(),
+	})
+}
+
+// watchBufferSize is the number of events buffered for each watcher
+var watchBufferSize = 1000
+
+// eventLogSize is the number of past events kept to replay them to the
+// watchers that reconnect
+var eventLogSize = 1000
+
+type eventEntry struct {
+	version uint64
+	event   Event
 }
 
 type Event struct {
@@ -188,46 +930,311 @@ type Event struct {
 }
 
 func (k *K8S) getPods(c echo.Context) error {
+	labelSelector, err := labels.Parse(c.QueryParam("labelSelector"))
+	if err != nil {
+		return statusError(c, http.StatusBadRequest, metav1.StatusReasonBadRequest, err.Error())
+	}
+	fieldSelector, err := fields.ParseSelector(c.QueryParam("fieldSelector"))
+	if err != nil {
+		return statusError(c, http.StatusBadRequest, metav1.StatusReasonBadRequest, err.Error())
+	}
+	namespace := c.Param("namespace")
+	matches := func(pod v1.Pod) bool {
+		return pod.ObjectMeta.Namespace == namespace && labelSelector.Matches(labels.Set(pod.ObjectMeta.Labels)) && fieldSelector.Matches(podFields(pod))
+	}
+
 	if c.QueryParam("watch") == "true" {
-		// check the index of the last event
-		updateCh := make(chan Event, 1000)
+		var resourceVersion uint64
+		if rv := c.QueryParam("resourceVersion"); rv != "" {
+			if resourceVersion, err = strconv.ParseUint(rv, 10, 64); err != nil {
+				return statusError(c, http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("invalid resource version '%s'", rv))
+			}
+		}
 
-		c.Response().Header().Set("Content-Type", "application/json")
+		updateCh := make(chan Event, watchBufferSize)
 
+		// register the watcher and take the events to replay at once so
+		// that no event is lost or sent twice
 		k.createLock.Lock()
+		replay, ok := k.eventsSince(resourceVersion)
+		if !ok {
+			current := k.resourceVersion
+			k.createLock.Unlock()
+			return statusError(c, http.StatusGone, metav1.StatusReasonExpired, fmt.Sprintf("too old resource version: %d (%d)", resourceVersion, current))
+		}
 		k.updateCh = append(k.updateCh, updateCh)
 		k.createLock.Unlock()
 
-		for event := range updateCh {
-			slog.Info("sending event")
+		c.Response().Header().Set("Content-Type", "application/json")
+
+		defer func() {
+			k.createLock.Lock()
+			k.removeWatcher(updateCh)
+			k.createLock.Unlock()
+		}()
 
+		for _, event := range replay {
+			if pod, ok := event.Object.(v1.Pod); ok && !matches(pod) {
+				continue
+			}
 			data, err := json.Marshal(event)
 			if err != nil {
 				return err
 			}
 			c.Response().Write(data)
-			c.Response().Flush()
+		}
+		c.Response().Flush()
 
-			// check if the connection is closed
+		ctx := c.Request().Context()
+		for {
 			select {
-			case <-c.Request().Context().Done():
+			case <-ctx.Done():
+				// the connection is closed
 				return nil
-			default:
+			case event, ok := <-updateCh:
+				if !ok {
+					// the watcher was too slow and it was dropped
+					return nil
+				}
+				if pod, ok := event.Object.(v1.Pod); ok && !matches(pod) {
+					continue
+				}
+				slog.Info("sending event")
+
+				data, err := json.Marshal(event)
+				if err != nil {
+					return err
+				}
+				c.Response().Write(data)
+				c.Response().Flush()
 			}
 		}
 	} else {
-		c.JSON(http.StatusOK, v1.PodList{
-			Items: k.pods,
-		})
+		k.createLock.Lock()
+		list := v1.PodList{
+			ListMeta: metav1.ListMeta{
+				ResourceVersion: strconv.FormatUint(k.resourceVersion, 10),
+			},
+		}
+		for _, pod := range k.listPods(namespace) {
+			if matches(*pod) {
+				list.Items = append(list.Items, *pod.DeepCopy())
+			}
+		}
+		k.createLock.Unlock()
+
+		c.JSON(http.StatusOK, list)
 	}
 
 	return nil
 }
 
+// deletePods removes the pods that match the label and field selectors and
+// stops their tasks. Spark calls it to remove executors and at the end of
+// the job.
+func (k *K8S) deletePods(c echo.Context) error {
+	labelSelector, err := labels.Parse(c.QueryParam("labelSelector"))
+	if err != nil {
+		return statusError(c, http.StatusBadRequest, metav1.StatusReasonBadRequest, err.Error())
+	}
+	fieldSelector, err := fields.ParseSelector(c.QueryParam("fieldSelector"))
+	if err != nil {
+		return statusError(c, http.StatusBadRequest, metav1.StatusReasonBadRequest, err.Error())
+	}
+
+	namespace := c.Param("namespace")
+
+	k.createLock.Lock()
+	names := []string{}
+	for _, pod := range k.listPods(namespace) {
+		if labelSelector.Matches(labels.Set(pod.ObjectMeta.Labels)) && fieldSelector.Matches(podFields(*pod)) {
+			names = append(names, pod.ObjectMeta.Name)
+		}
+	}
+	handles := []*taskHandle{}
+	for _, name := range names {
+		k.removePod(namespace, name)
+		if handle := k.findHandle(namespace, name); handle != nil {
+			handles = append(handles, handle)
+		}
+	}
+	k.createLock.Unlock()
+
+	for _, handle := range handles {
+		if err := k.provider.StopTask(c.Request().Context(), handle); err != nil {
+			slog.Error("failed to stop task", "name", handle.Name, "err", err)
+		}
+	}
+	return c.JSON(http.StatusOK, metav1.Status{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Status",
+			APIVersion: "v1",
+		},
+		Status: metav1.StatusSuccess,
+		Details: &metav1.StatusDetails{
+			Kind: "pods",
+		},
+	})
+}
+
+// podFields are the fields of the pod supported in the field selectors
+func podFields(pod v1.Pod) fields.Set {
+	return fields.Set{
+		"metadata.name":      pod.ObjectMeta.Name,
+		"metadata.namespace": pod.ObjectMeta.Namespace,
+		"status.phase":       string(pod.Status.Phase),
+	}
+}
+
+// removePod removes the pod and emits its DELETED event. It returns nil if
+// the pod does not exist. It must be called with the createLock held.
+func (k *K8S) removePod(namespace, name string) *v1.Pod {
+	pod := k.findPod(namespace, name)
+	if pod == nil {
+		return nil
+	}
+
+	now := metav1.Now()
+	pod.ObjectMeta.DeletionTimestamp = &now
+	k.emitEvent("DELETED", pod)
+
+	delete(k.pods[namespace], name)
+	if len(k.pods[namespace]) == 0 {
+		delete(k.pods, namespace)
+	}
+	return pod.DeepCopy()
+}
+
+// listPods returns the stored pods of the namespace, or of all the namespaces
+// if it is empty, sorted by namespace and name. It must be called with the
+// createLock held.
+func (k *K8S) listPods(namespace string) []*v1.Pod {
+	pods := []*v1.Pod{}
+	for ns, byName := range k.pods {
+		if namespace != "" && ns != namespace {
+			continue
+		}
+		for _, pod := range byName {
+			pods = append(pods, pod)
+		}
+	}
+	sort.Slice(pods, func(i, j int) bool {
+		if pods[i].ObjectMeta.Namespace != pods[j].ObjectMeta.Namespace {
+			return pods[i].ObjectMeta.Namespace < pods[j].ObjectMeta.Namespace
+		}
+		return pods[i].ObjectMeta.Name < pods[j].ObjectMeta.Name
+	})
+	return pods
+}
+
+func (k *K8S) getPod(c echo.Context) error {
+	name := c.Param("name")
+
+	k.createLock.Lock()
+	var pod *v1.Pod
+	if stored := k.findPod(c.Param("namespace"), name); stored != nil {
+		pod = stored.DeepCopy()
+	}
+	k.createLock.Unlock()
+
+	if pod == nil {
+		return statusError(c, http.StatusNotFound, metav1.StatusReasonNotFound, fmt.Sprintf("pods \"%s\" not found", name))
+	}
+	return c.JSON(http.StatusOK, pod)
+}
+
+// postPodBinding accepts the binding of a pod to a node. It is a no-op since
+// the task of the pod is already scheduled in the provider. The pod is not
+// required to exist yet, it is created in the background.
+func (k *K8S) postPodBinding(c echo.Context) error {
+	var binding v1.Binding
+	if err := c.Bind(&binding); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, metav1.Status{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Status",
+			APIVersion: "v1",
+		},
+		Status: metav1.StatusSuccess,
+		Code:   http.StatusCreated,
+	})
+}
+
+func (k *K8S) deletePod(c echo.Context) error {
+	name := c.Param("name")
+
+	namespace := c.Param("namespace")
+
+	k.createLock.Lock()
+	pod := k.removePod(namespace, name)
+	handle := k.findHandle(namespace, name)
+	k.createLock.Unlock()
+
+	if pod == nil {
+		return statusError(c, http.StatusNotFound, metav1.StatusReasonNotFound, fmt.Sprintf("pods \"%s\" not found", name))
+	}
+	if handle != nil {
+		if err := k.provider.StopTask(c.Request().Context(), handle); err != nil {
+			return err
+		}
+	}
+	return c.JSON(http.StatusOK, pod)
+}
+
+func (k *K8S) getConfigMaps(c echo.Context) error {
+	selector, err := labels.Parse(c.QueryParam("labelSelector"))
+	if err != nil {
+		return statusError(c, http.StatusBadRequest, metav1.StatusReasonBadRequest, err.Error())
+	}
+	namespace := c.Param("namespace")
+
+	k.configMapsLock.Lock()
+	items := []v1.ConfigMap{}
+	for _, configMap := range k.configMaps {
+		if configMap.ObjectMeta.Namespace == namespace && selector.Matches(labels.Set(configMap.ObjectMeta.Labels)) {
+			items = append(items, configMap)
+		}
+	}
+	k.configMapsLock.Unlock()
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].ObjectMeta.Name < items[j].ObjectMeta.Name
+	})
+	return c.JSON(http.StatusOK, v1.ConfigMapList{Items: items})
+}
+
 func (k *K8S) getConfigMap(c echo.Context) error {
-	c.JSON(http.StatusOK, v1.ConfigMapList{})
+	name := c.Param("name")
 
-	return nil
+	k.configMapsLock.Lock()
+	configMap, ok := k.configMaps[c.Param("namespace")+"/"+name]
+	k.configMapsLock.Unlock()
+
+	if !ok {
+		return statusError(c, http.StatusNotFound, metav1.StatusReasonNotFound, fmt.Sprintf("configmaps \"%s\" not found", name))
+	}
+	return c.JSON(http.StatusOK, configMap)
+}
+
+// deleteConfigMaps removes the config maps that match the label selector.
+// Spark calls it at the end of the job.
+func (k *K8S) deleteConfigMaps(c echo.Context) error {
+	selector, err := labels.Parse(c.QueryParam("labelSelector"))
+	if err != nil {
+		return statusError(c, http.StatusBadRequest, metav1.StatusReasonBadRequest, err.Error())
+	}
+	namespace := c.Param("namespace")
+
+	k.configMapsLock.Lock()
+	for key, configMap := range k.configMaps {
+		if configMap.ObjectMeta.Namespace == namespace && selector.Matches(labels.Set(configMap.ObjectMeta.Labels)) {
+			delete(k.configMaps, key)
+		}
+	}
+	k.configMapsLock.Unlock()
+
+	return c.NoContent(http.StatusOK)
 }
 
 func (k *K8S) postPods(c echo.Context) error {
@@ -235,76 +1242,615 @@ func (k *K8S) postPods(c echo.Context) error {
 	if err := c.Bind(&pod); err != nil {
 		return err
 	}
-	go func() {
-		if err := k.createPod(pod); err != nil {
-			slog.Error("error creating pod", "err", err)
-		}
-	}()
+	pod.ObjectMeta.Namespace = c.Param("namespace")
+
+	// a retried request returns the existing pod instead of creating
+	// a second task for it
+	existing, err := k.addPendingPod(pod)
+	if err != nil {
+		return statusError(c, http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, err.Error())
+	}
+	if existing != nil {
+		slog.Info("pod already exists", "name", pod.ObjectMeta.Name, "request-id", requestId(c))
+		return c.JSON(http.StatusOK, existing)
+	}
+	go k.createPodAsync(pod, requestId(c))
 
 	return c.JSON(http.StatusOK, pod)
 }
 
 func (k *K8S) Close() {
+	k.cancelFn()
+	k.reconcilerWg.Wait()
+
+	if k.server != nil {
+		// close the watches first so that their handlers return
+		k.createLock.Lock()
+		for len(k.updateCh) != 0 {
+			k.removeWatcher(k.updateCh[0])
+		}
+		k.createLock.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := k.server.Shutdown(ctx); err != nil {
+			slog.Error("failed to shutdown the server", "err", err)
+		}
+	}
+
+	if k.tracingShutdownFn != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := k.tracingShutdownFn(ctx); err != nil {
+			slog.Error("failed to flush traces", "err", err)
+		}
+	}
+}
+
+// createPodAsync creates the task of a pending pod in the background. A failure
+// (or a panic) only affects the pod and not the control plane. The request id
+// is the one of the API request that created the pod.
+func (k *K8S) createPodAsync(pod v1.Pod, requestId string) {
+	namespace, name := pod.ObjectMeta.Namespace, pod.ObjectMeta.Name
+
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("panic creating pod", "name", name, "request-id", requestId, "containers", len(pod.Spec.Containers), "panic", r)
+			k.failPendingPod(namespace, name, fmt.Errorf("panic creating pod: %v", r))
+		}
+	}()
+
+	// the pods of a job (spark-app-name is the name of the job) are traced
+	// under its deploy
+	ctx := trace.ContextWithSpanContext(k.ctx, k.deploySpan(pod.ObjectMeta.Labels["spark-app-name"]))
+	ctx, span := tracer.Start(ctx, "createPod", trace.WithAttributes(attribute.String("pod.name", name), attribute.String("request.id", requestId)))
+
+	// like the kubelet, do not start the containers until the config maps
+	// of their volumes exist (spark-submit creates them after the driver)
+	err := k.waitForConfigMaps(ctx, pod)
+	if err == nil {
+		err = k.createPod(ctx, pod, requestId)
+	}
+	endSpan(span, err)
+	if err != nil && k.ctx.Err() == nil {
+		slog.Error("error creating pod", "name", name, "request-id", requestId, "containers", len(pod.Spec.Containers), "err", err)
+		k.metrics.podCreateFailed()
+		k.failPendingPod(namespace, name, err)
+	}
 }
 
-func (k *K8S) createPod(pod v1.Pod) error {
+// addPendingPod stores the pod in the pending phase and emits its ADDED event.
+// The pod is pending until its task is created, Spark can delete it in the
+// meantime (i.e. dynamic allocation removes the pending executors). If a pod
+// with the same namespace and name exists, a copy of it is returned instead.
+func (k *K8S) addPendingPod(pod v1.Pod) (*v1.Pod, error) {
 	k.createLock.Lock()
 	defer k.createLock.Unlock()
 
-	k.resourceVersion++
+	if len(pod.Spec.Containers) == 0 {
+		return nil, fmt.Errorf("pod %s has no containers", pod.ObjectMeta.Name)
+	}
+	if existing := k.findPod(pod.ObjectMeta.Namespace, pod.ObjectMeta.Name); existing != nil {
+		return existing.DeepCopy(), nil
+	}
 
-	// assume only one container per pod, otherwise it requires special
-	// networking protocols
-	if len(pod.Spec.Containers) != 1 {
-		panic("only one container per pod is supported")
+	pod.Status.Phase = v1.PodPending
+	if k.pods[pod.ObjectMeta.Namespace] == nil {
+		k.pods[pod.ObjectMeta.Namespace] = map[string]*v1.Pod{}
 	}
-	cc := pod.Spec.Containers[0]
+	k.pods[pod.ObjectMeta.Namespace][pod.ObjectMeta.Name] = &pod
+	k.emitEvent("ADDED", &pod)
+
+	return nil, nil
+}
+
+// failPendingPod marks the pod as failed because its task could not be
+// created and removes it
+func (k *K8S) failPendingPod(namespace, name string, err error) {
+	k.createLock.Lock()
+	defer k.createLock.Unlock()
+
+	pod := k.findPod(namespace, name)
+	if pod == nil {
+		return
+	}
+	pod.Status.Phase = v1.PodFailed
+	pod.Status.Message = err.Error()
+	k.emitEvent("MODIFIED", pod)
+	k.removePod(namespace, name)
+}
+
+// findPod returns the stored pod, it must be called with the createLock held
+func (k *K8S) findPod(namespace, name string) *v1.Pod {
+	return k.pods[namespace][name]
+}
+
+// createPod creates the task of a pending pod and sets the pod as running.
+// If the pod is deleted while the task is created, the task is stopped.
+func (k *K8S) createPod(ctx context.Context, pod v1.Pod, requestId string) error {
+	namespace, name := pod.ObjectMeta.Namespace, pod.ObjectMeta.Name
+
+	k.createLock.Lock()
+	deleted := k.findPod(namespace, name) == nil
+	k.createLock.Unlock()
+	if deleted {
+		return nil
+	}
+
+	// the main container is the spark one, the rest run as sidecars
+	// that share its network
+	mainIndx := podMainContainer(pod)
+	cc := pod.Spec.Containers[mainIndx]
 
 	// convert pod to task
 	task := &Task{
 		Name:  pod.ObjectMeta.Name,
 		Image: cc.Image,
 		Args:  cc.Args,
-		Env:   make(map[string]string),
+		Env:   k.globalEnv(),
+		User:  podUser(pod, cc, k.config.RunAsUser),
+
+		DNSServers: k.config.DNSServers,
+		Labels:     k.taskLabels(pod.ObjectMeta.Labels["spark-app-name"], pod.ObjectMeta.Name),
+		Provider:   pod.ObjectMeta.Annotations[annotationProvider],
+		RequestId:  requestId,
+	}
+	task.Cpu, task.Memory = podResources(cc)
+	task.Mounts = podMounts(pod, cc)
+	task.Files = k.podFiles(pod, cc)
+	task.Aliases = k.podAliases(pod)
+	for i, sc := range pod.Spec.Containers {
+		if i == mainIndx {
+			continue
+		}
+		sidecar := Sidecar{
+			Name:    sc.Name,
+			Image:   sc.Image,
+			Command: sc.Command,
+			Args:    sc.Args,
+			Env:     map[string]string{},
+		}
+		for _, kv := range sc.Env {
+			sidecar.Env[kv.Name] = kv.Value
+		}
+		task.Sidecars = append(task.Sidecars, sidecar)
+	}
+	for _, port := range cc.Ports {
+		if port.Protocol == "" || port.Protocol == v1.ProtocolTCP {
+			task.Ports = append(task.Ports, port.ContainerPort)
+		}
 	}
 	for _, kv := range cc.Env {
-		// override the SPARK_LOCAL_DIRS to point to /tmp
-		if kv.Name == "SPARK_LOCAL_DIRS" {
-			task.Env[kv.Name] = "/tmp"
+		// override the SPARK_LOCAL_DIRS to point to a writable path
+		if kv.Name == "SPARK_LOCAL_DIRS" && !k.config.DisableLocalDirsRemap {
+			task.Env[kv.Name] = k.config.LocalDirsPath
+			continue
+		}
+
+		// the driver of the cluster deploy mode binds to the ip of its pod,
+		// which is not known before the task starts
+		if kv.Name == "SPARK_DRIVER_BIND_ADDRESS" && kv.ValueFrom != nil && kv.ValueFrom.FieldRef != nil {
+			task.Env[kv.Name] = "0.0.0.0"
 			continue
 		}
 
 		task.Env[kv.Name] = kv.Value
 	}
 
-	handle, err := k.provider.CreateTask(task)
+	// the pod is left pending
+	if k.config.DryRun {
+		k.logDryRun(task)
+		return nil
+	}
+
+	// wait for a free slot if the concurrent creations are limited
+	if k.createSem != nil {
+		select {
+		case k.createSem <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	start := time.Now()
+	handle, err := k.createTask(ctx, task, func(handle *taskHandle) {
+		handle.Name = name
+		handle.Namespace = namespace
+		handle.RequestId = requestId
+		handle.task = task
+		handle.spanCtx = k.deploySpan(pod.ObjectMeta.Labels["spark-app-name"])
+	})
+	if k.createSem != nil {
+		<-k.createSem
+	}
 	if err != nil {
+		k.metrics.taskCreateFailed()
 		return err
 	}
+	k.metrics.taskCreated(time.Since(start))
+
+	slog.Info("task created", "name", handle.Name, "id", handle.ShortId, "request-id", requestId)
+
+	k.createLock.Lock()
+	stored := k.findPod(namespace, name)
+	if stored != nil {
+		stored.Status.Phase = v1.PodRunning
+		k.emitEvent("MODIFIED", stored)
+	}
+	k.createLock.Unlock()
+
+	if stored == nil {
+		slog.Info("pod deleted while its task was created, stopping it", "name", name, "id", handle.ShortId, "request-id", requestId)
+		return k.provider.StopTask(ctx, handle)
+	}
+
+	if k.config.MaxTaskRuntime != 0 {
+		go k.enforceMaxRuntime(handle)
+	}
+	go k.watchTask(handle)
+
+	return nil
+}
+
+// watchTask waits for the task of a pod to finish, then it sets the final
+// phase of the pod and it emits the MODIFIED and DELETED events so that
+// Spark tracks the lifecycle of the executors.
+func (k *K8S) watchTask(handle *taskHandle) {
+	err := k.provider.WaitForTask(k.ctx, handle)
+	if k.ctx.Err() != nil {
+		return
+	}
+	k.metrics.taskFinished(k.finishHandle(handle, err), err != nil)
+
+	// the pod keeps running with the restarted task
+	if err != nil && k.restartTask(handle, err) {
+		return
+	}
+
+	k.createLock.Lock()
+	defer k.createLock.Unlock()
 
-	slog.Info("task created", "name", handle.Name, "id", handle.Id)
+	pod := k.findPod(handle.Namespace, handle.Name)
+	if pod == nil {
+		return
+	}
 
-	handle.Name = pod.ObjectMeta.Name
-	k.addHandle(handle)
+	// keep the phase if it already failed (i.e. max runtime exceeded)
+	if pod.Status.Phase != v1.PodSucceeded && pod.Status.Phase != v1.PodFailed {
+		if err != nil {
+			pod.Status.Phase = v1.PodFailed
+			pod.Status.Message = err.Error()
+		} else {
+			pod.Status.Phase = v1.PodSucceeded
+		}
+	}
+	k.emitEvent("MODIFIED", pod)
+	k.removePod(handle.Namespace, handle.Name)
+}
 
-	// just put already as running
-	pod.Status.Phase = v1.PodRunning
+// enforceMaxRuntime stops the task if it runs for longer than MaxTaskRuntime
+// and marks its pod as failed.
+func (k *K8S) enforceMaxRuntime(handle *taskHandle) {
+	ctx, cancel := context.WithTimeout(k.ctx, k.config.MaxTaskRuntime)
+	defer cancel()
 
-	k.pods = append(k.pods, pod)
+	if err := k.provider.WaitForTask(ctx, handle); err == nil || ctx.Err() != context.DeadlineExceeded {
+		return
+	}
 
-	// add an update with increasing resourceVersion
-	pod = *pod.DeepCopy()
-	pod.ObjectMeta.ResourceVersion = fmt.Sprintf("%d", k.resourceVersion)
+	slog.Info("task exceeded max runtime, stopping", "name", handle.Name, "id", handle.ShortId, "max-runtime", k.config.MaxTaskRuntime)
+
+	if err := k.provider.StopTask(k.ctx, handle); err != nil {
+		slog.Error("failed to stop task", "name", handle.Name, "err", err)
+	}
+
+	k.createLock.Lock()
+	defer k.createLock.Unlock()
+
+	if pod := k.findPod(handle.Namespace, handle.Name); pod != nil {
+		pod.Status.Phase = v1.PodFailed
+		pod.Status.Reason = "MaxRuntimeExceeded"
+		pod.Status.Message = fmt.Sprintf("max runtime exceeded (%s)", k.config.MaxTaskRuntime)
+		k.emitEvent("MODIFIED", pod)
+	}
+}
+
+// emitEvent sets an increasing resourceVersion on the stored pod and sends
+// a watch event for it. It must be called with the createLock held.
+func (k *K8S) emitEvent(eventType string, pod *v1.Pod) {
+	k.resourceVersion++
+	pod.ObjectMeta.ResourceVersion = strconv.FormatUint(k.resourceVersion, 10)
 
 	event := Event{
-		Type:   "ADDED",
-		Object: pod,
+		Type:   eventType,
+		Object: *pod.DeepCopy(),
 	}
-	for _, ch := range k.updateCh {
-		ch <- event
+
+	k.events = append(k.events, eventEntry{version: k.resourceVersion, event: event})
+	if len(k.events) > eventLogSize {
+		k.events = k.events[len(k.events)-eventLogSize:]
 	}
 
-	return nil
+	for _, ch := range append([]chan Event{}, k.updateCh...) {
+		select {
+		case ch <- event:
+		default:
+			// do not block on a slow watcher, it is closed and the
+			// client has to list and watch again
+			slog.Warn("watcher is too slow, closing it")
+			k.removeWatcher(ch)
+		}
+	}
+}
+
+// eventsSince returns the events newer than the resource version. It
+// returns false if some of them are not in the event log anymore.
+// A zero resource version means that no event is replayed. It must be
+// called with the createLock held.
+func (k *K8S) eventsSince(resourceVersion uint64) ([]Event, bool) {
+	if resourceVersion == 0 || resourceVersion >= k.resourceVersion {
+		return nil, true
+	}
+	if len(k.events) == 0 || k.events[0].version > resourceVersion+1 {
+		return nil, false
+	}
+
+	events := []Event{}
+	for _, entry := range k.events {
+		if entry.version > resourceVersion {
+			events = append(events, entry.event)
+		}
+	}
+	return events, true
+}
+
+// removeWatcher removes and closes the watch channel if it is still
+// registered. It must be called with the createLock held.
+func (k *K8S) removeWatcher(ch chan Event) {
+	for i, updateCh := range k.updateCh {
+		if updateCh == ch {
+			k.updateCh = append(k.updateCh[:i], k.updateCh[i+1:]...)
+			close(ch)
+			return
+		}
+	}
+}
+
+// patchPod handles the server-side apply requests on pods. The applied pod
+// is created if it does not exist, otherwise its labels and annotations are
+// replaced (last writer wins, field managers are not tracked). The merge
+// patches are applied to the metadata of an existing pod.
+func (k *K8S) patchPod(c echo.Context) error {
+	if isMergePatch(c.Request().Header.Get(echo.HeaderContentType)) {
+		return k.mergePatchPod(c)
+	}
+
+	var pod v1.Pod
+	if ok, err := bindApplyPatch(c, &pod.ObjectMeta, &pod); !ok {
+		return err
+	}
+	k.createLock.Lock()
+	if existing := k.findPod(pod.ObjectMeta.Namespace, pod.ObjectMeta.Name); existing != nil {
+		existing.ObjectMeta.Labels = pod.ObjectMeta.Labels
+		existing.ObjectMeta.Annotations = pod.ObjectMeta.Annotations
+		k.emitEvent("MODIFIED", existing)
+
+		result := *existing.DeepCopy()
+		k.createLock.Unlock()
+
+		return c.JSON(http.StatusOK, result)
+	}
+	k.createLock.Unlock()
+
+	existing, err := k.addPendingPod(pod)
+	if err != nil {
+		return statusError(c, http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, err.Error())
+	}
+	if existing != nil {
+		return c.JSON(http.StatusOK, existing)
+	}
+	go k.createPodAsync(pod, requestId(c))
+
+	return c.JSON(http.StatusCreated, pod)
+}
+
+// statusError writes a failure Kubernetes Status object
+func statusError(c echo.Context, code int, reason metav1.StatusReason, message string) error {
+	return c.JSON(code, metav1.Status{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Status",
+			APIVersion: "v1",
+		},
+		Status:  metav1.StatusFailure,
+		Message: message,
+		Reason:  reason,
+		Code:    int32(code),
+	})
+}
+
+// sparkContainerNames are the default names of the spark containers
+var sparkContainerNames = []string{"spark-kubernetes-driver", "spark-kubernetes-executor"}
+
+// podMainContainer returns the index of the spark container of the pod, or
+// the first container if none has the name of a spark container.
+func podMainContainer(pod v1.Pod) int {
+	for i, cc := range pod.Spec.Containers {
+		for _, name := range sparkContainerNames {
+			if cc.Name == name {
+				return i
+			}
+		}
+	}
+	return 0
+}
+
+// podMounts returns the mounts of the hostPath volumes of the container
+func podMounts(pod v1.Pod, cc v1.Container) []Mount {
+	hostPaths := map[string]string{}
+	for _, volume := range pod.Spec.Volumes {
+		if volume.HostPath != nil {
+			hostPaths[volume.Name] = volume.HostPath.Path
+		}
+	}
+
+	mounts := []Mount{}
+	for _, volumeMount := range cc.VolumeMounts {
+		hostPath, ok := hostPaths[volumeMount.Name]
+		if !ok {
+			continue
+		}
+		if volumeMount.SubPath != "" {
+			hostPath = filepath.Join(hostPath, volumeMount.SubPath)
+		}
+		mounts = append(mounts, Mount{
+			HostPath:      hostPath,
+			ContainerPath: volumeMount.MountPath,
+			ReadOnly:      volumeMount.ReadOnly,
+		})
+	}
+	return mounts
+}
+
+// podFiles returns the files of the config map volumes mounted in the
+// container. The config maps that do not exist are skipped.
+func (k *K8S) podFiles(pod v1.Pod, cc v1.Container) []File {
+	volumes := map[string]*v1.ConfigMapVolumeSource{}
+	for _, volume := range pod.Spec.Volumes {
+		if volume.ConfigMap != nil {
+			volumes[volume.Name] = volume.ConfigMap
+		}
+	}
+
+	k.configMapsLock.Lock()
+	defer k.configMapsLock.Unlock()
+
+	files := []File{}
+	for _, volumeMount := range cc.VolumeMounts {
+		source, ok := volumes[volumeMount.Name]
+		if !ok {
+			continue
+		}
+		configMap, ok := k.configMaps[pod.ObjectMeta.Namespace+"/"+source.Name]
+		if !ok {
+			continue
+		}
+
+		// all the keys are mounted unless the items select some of them
+		paths := map[string]string{}
+		if len(source.Items) == 0 {
+			for key := range configMap.Data {
+				paths[key] = key
+			}
+		}
+		for _, item := range source.Items {
+			paths[item.Key] = item.Path
+		}
+
+		for key, path := range paths {
+			if volumeMount.SubPath != "" {
+				if path != volumeMount.SubPath {
+					continue
+				}
+				path = ""
+			}
+			data, ok := configMap.Data[key]
+			if !ok {
+				continue
+			}
+			files = append(files, File{
+				Path:    filepath.Join(volumeMount.MountPath, path),
+				Content: []byte(data),
+			})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	return files
+}
+
+// configMapWaitTimeout is how long a pod waits for the config maps of its volumes
+var configMapWaitTimeout = 1 * time.Minute
+
+// waitForConfigMaps waits until the config maps of the volumes of the pod
+// exist, the optional ones are not waited for.
+func (k *K8S) waitForConfigMaps(ctx context.Context, pod v1.Pod) error {
+	names := []string{}
+	for _, volume := range pod.Spec.Volumes {
+		if volume.ConfigMap != nil && (volume.ConfigMap.Optional == nil || !*volume.ConfigMap.Optional) {
+			names = append(names, volume.ConfigMap.Name)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, configMapWaitTimeout)
+	defer cancel()
+
+	for {
+		missing := []string{}
+		k.configMapsLock.Lock()
+		for _, name := range names {
+			if _, ok := k.configMaps[pod.ObjectMeta.Namespace+"/"+name]; !ok {
+				missing = append(missing, name)
+			}
+		}
+		k.configMapsLock.Unlock()
+
+		if len(missing) == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("config maps %v of pod %s not found: %w", missing, pod.ObjectMeta.Name, ctx.Err())
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// podUser returns the UID[:GID] to run the container as, giving precedence
+// to the container security context over the pod one.
+func podUser(pod v1.Pod, cc v1.Container, defaultUser string) string {
+	var uid, gid *int64
+	if sc := pod.Spec.SecurityContext; sc != nil {
+		uid, gid = sc.RunAsUser, sc.RunAsGroup
+	}
+	if sc := cc.SecurityContext; sc != nil {
+		if sc.RunAsUser != nil {
+			uid = sc.RunAsUser
+		}
+		if sc.RunAsGroup != nil {
+			gid = sc.RunAsGroup
+		}
+	}
+	if uid == nil {
+		return defaultUser
+	}
+	user := strconv.FormatInt(*uid, 10)
+	if gid != nil {
+		user += ":" + strconv.FormatInt(*gid, 10)
+	}
+	return user
+}
+
+// podResources returns the cpu (millicores) and memory (bytes) of the
+// container, using the limits if set and the requests otherwise.
+func podResources(cc v1.Container) (cpu int64, memory int64) {
+	quantity := func(name v1.ResourceName) (resource.Quantity, bool) {
+		if q, ok := cc.Resources.Limits[name]; ok {
+			return q, true
+		}
+		q, ok := cc.Resources.Requests[name]
+		return q, ok
+	}
+	if q, ok := quantity(v1.ResourceCPU); ok {
+		cpu = q.MilliValue()
+	}
+	if q, ok := quantity(v1.ResourceMemory); ok {
+		memory = q.Value()
+	}
+	return
 }
 
 func (k *K8S) postConfigMaps(c echo.Context) error {
@@ -312,23 +1858,211 @@ func (k *K8S) postConfigMaps(c echo.Context) error {
 	if err := c.Bind(&configMap); err != nil {
 		return err
 	}
+	if configMap.ObjectMeta.Name == "" {
+		return statusError(c, http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "the name of the config map is required")
+	}
+	configMap.ObjectMeta.Namespace = c.Param("namespace")
+	configMap.ObjectMeta.CreationTimestamp = metav1.Now()
+
+	key := configMap.ObjectMeta.Namespace + "/" + configMap.ObjectMeta.Name
+
+	k.configMapsLock.Lock()
+	defer k.configMapsLock.Unlock()
+
+	if _, ok := k.configMaps[key]; ok {
+		return statusError(c, http.StatusConflict, metav1.StatusReasonAlreadyExists, fmt.Sprintf("configmaps \"%s\" already exists", configMap.ObjectMeta.Name))
+	}
+	k.configMaps[key] = configMap
+
+	return c.JSON(http.StatusCreated, configMap)
+}
+
+// patchConfigMap handles the server-side apply requests on config maps. The
+// applied config map is created or replaces the existing one.
+func (k *K8S) patchConfigMap(c echo.Context) error {
+	var configMap v1.ConfigMap
+	if ok, err := bindApplyPatch(c, &configMap.ObjectMeta, &configMap); !ok {
+		return err
+	}
+
+	key := configMap.ObjectMeta.Namespace + "/" + configMap.ObjectMeta.Name
+
+	k.configMapsLock.Lock()
+	defer k.configMapsLock.Unlock()
+
+	if existing, ok := k.configMaps[key]; ok {
+		configMap.ObjectMeta.CreationTimestamp = existing.ObjectMeta.CreationTimestamp
+	} else {
+		configMap.ObjectMeta.CreationTimestamp = metav1.Now()
+	}
+	k.configMaps[key] = configMap
+
 	return c.JSON(http.StatusOK, configMap)
 }
 
+// bindApplyPatch decodes the body of a server-side apply request into obj,
+// whose metadata is meta, and checks that its name matches the one on the
+// URL. If it returns false, the error response is already written or the
+// error is returned.
+func bindApplyPatch(c echo.Context, meta *metav1.ObjectMeta, obj interface{}) (bool, error) {
+	contentType := c.Request().Header.Get(echo.HeaderContentType)
+	if !strings.HasPrefix(contentType, "application/apply-patch+yaml") {
+		return false, statusError(c, http.StatusUnsupportedMediaType, metav1.StatusReasonUnsupportedMediaType, fmt.Sprintf("unsupported patch type '%s'", contentType))
+	}
+
+	data, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return false, err
+	}
+	if err := yaml.Unmarshal(data, obj); err != nil {
+		return false, statusError(c, http.StatusBadRequest, metav1.StatusReasonBadRequest, err.Error())
+	}
+
+	name := c.Param("name")
+	if meta.Name == "" {
+		meta.Name = name
+	} else if meta.Name != name {
+		return false, statusError(c, http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("the name of the object (%s) does not match the name on the URL (%s)", meta.Name, name))
+	}
+	meta.Namespace = c.Param("namespace")
+	return true, nil
+}
+
 type Task struct {
 	Name  string
 	Image string
 	Args  []string
 	Env   map[string]string
+
+	// User is the UID[:GID] to run the task as. Empty uses the image default.
+	User string
+
+	// DNSServers overrides the DNS servers of the task
+	DNSServers []string
+
+	// Labels identify the task in the provider (i.e. ECS tags)
+	Labels map[string]string
+
+	// Cpu is the cpu of the task in millicores. Zero uses the provider default.
+	Cpu int64
+
+	// Memory is the memory of the task in bytes. Zero uses the provider default.
+	Memory int64
+
+	// Provider is the name of the provider to run the task. Empty uses the default one.
+	Provider string
+
+	// Ports are the TCP ports the task listens on (i.e. the driver and
+	// block manager ports of Spark)
+	Ports []int32
+
+	// Mounts are the host paths mounted in the task
+	Mounts []Mount
+
+	// Files are written in the task before it starts (i.e. the config
+	// maps mounted in the pod)
+	Files []File
+
+	// Aliases are extra hostnames of the task in the network of the
+	// provider (i.e. the services that select the pod)
+	Aliases []string
+
+	// Sidecars are extra containers that run along the main one and share
+	// its network. The logs and the exit code are the ones of the main
+	// container.
+	Sidecars []Sidecar
+
+	// RequestId is the id of the API request that created the pod of the
+	// task, for the logs
+	RequestId string
+}
+
+// Sidecar is an extra container of a task
+type Sidecar struct {
+	Name    string
+	Image   string
+	Command []string
+	Args    []string
+	Env     map[string]string
+}
+
+// Mount is a host path mounted in a task
+type Mount struct {
+	HostPath      string
+	ContainerPath string
+	ReadOnly      bool
 }
 
+// File is a file written in a task
+type File struct {
+	Path    string
+	Content []byte
+}
+
+const (
+	labelRunId   = "sparkanywhere.io/run-id"
+	labelAppName = "sparkanywhere.io/app-name"
+	labelPodName = "sparkanywhere.io/pod-name"
+)
+
 type provider interface {
-	CreateTask(task *Task) (*taskHandle, error)
-	WaitForTask(handle *taskHandle) error
-	GetLogs(handle *taskHandle) (string, error)
+	CreateTask(ctx context.Context, task *Task) (*taskHandle, error)
+	WaitForTask(ctx context.Context, handle *taskHandle) error
+	GetLogs(ctx context.Context, handle *taskHandle) (string, error)
+	StopTask(ctx context.Context, handle *taskHandle) error
+	TaskStatus(ctx context.Context, handle *taskHandle) (TaskPhase, error)
 }
 
+// TaskPhase is the lifecycle phase of a task, it maps to the phase of its pod
+type TaskPhase string
+
+const (
+	TaskPending   TaskPhase = "Pending"
+	TaskRunning   TaskPhase = "Running"
+	TaskSucceeded TaskPhase = "Succeeded"
+	TaskFailed    TaskPhase = "Failed"
+)
+
 type taskHandle struct {
 	Name string
 	Id   string
+
+	// Namespace is the namespace of the pod of the task, empty for the
+	// driver of the client deploy mode
+	Namespace string
+
+	// SidecarIds are the ids of the sidecar containers (docker only)
+	SidecarIds []string
+
+	// ShortId is a readable id for the logs (i.e. the task id of an ECS
+	// task ARN). Id is still used for the provider API calls.
+	ShortId string
+
+	// Provider is the name of the provider that runs the task
+	Provider string
+
+	// RequestId is the id of the API request that created the task
+	RequestId string
+
+	// StartedAt is when the task reached running, it is set by the provider
+	// before the handle is returned
+	StartedAt time.Time
+
+	// StoppedAt is when WaitForTask returned, err is the exit error of
+	// the task and phase and exitCode its final status (exitCode is nil if
+	// unknown). They are recorded before the task can be removed from the
+	// provider and are set with the handlesLock held.
+	StoppedAt time.Time
+	err       string
+	phase     TaskPhase
+	exitCode  *int
+
+	// Restarts is the number of times the task of the pod was restarted
+	// before this one, task is its spec to restart it
+	Restarts int
+	task     *Task
+
+	// spanCtx is the span context of the deploy of the task, the spans
+	// of the calls made after it is created are its children
+	spanCtx trace.SpanContext
 }
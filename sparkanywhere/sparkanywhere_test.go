@@ -0,0 +1,371 @@
+package sparkanywhere
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newTestK8S returns a control plane that runs its tasks in a FakeProvider
+func newTestK8S(t *testing.T, config *Config) (*K8S, *FakeProvider) {
+	t.Helper()
+
+	fake := NewFakeProvider()
+	config.FakeProvider = fake
+	config.ControlPlaneAddr = "localhost"
+	config.LogDir = t.TempDir()
+
+	k, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(k.Close)
+	return k, fake
+}
+
+// serve calls the handler with a request to the pods of the namespace
+func serve(t *testing.T, handler echo.HandlerFunc, method, contentType string, body interface{}, params ...string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(method, "/", bytes.NewReader(data))
+	req.Header.Set(echo.HeaderContentType, contentType)
+	rec := httptest.NewRecorder()
+
+	c := echo.New().NewContext(req, rec)
+	names := []string{"namespace", "name"}
+	c.SetParamNames(names[:len(params)]...)
+	c.SetParamValues(params...)
+
+	if err := handler(c); err != nil {
+		var httpErr *echo.HTTPError
+		if !errors.As(err, &httpErr) {
+			t.Fatal(err)
+		}
+		rec.Code = httpErr.Code
+	}
+	return rec
+}
+
+func testPod(name string) v1.Pod {
+	return v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{"spark-role": "executor"},
+		},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{
+				{
+					Name:  "executor",
+					Image: "apache/spark",
+					Args:  []string{"executor"},
+				},
+			},
+		},
+	}
+}
+
+// waitFor polls the condition until it is true or the test times out
+func waitFor(t *testing.T, msg string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// podPhase returns the phase of the stored pod, empty if it does not exist
+func (k *K8S) podPhase(namespace, name string) v1.PodPhase {
+	k.createLock.Lock()
+	defer k.createLock.Unlock()
+
+	if pod := k.findPod(namespace, name); pod != nil {
+		return pod.Status.Phase
+	}
+	return ""
+}
+
+// podEvents returns the type and phase of the events of the pod
+func (k *K8S) podEvents(name string) []string {
+	k.createLock.Lock()
+	defer k.createLock.Unlock()
+
+	events := []string{}
+	for _, entry := range k.events {
+		if pod := entry.event.Object.(v1.Pod); pod.Name == name {
+			events = append(events, entry.event.Type+" "+string(pod.Status.Phase))
+		}
+	}
+	return events
+}
+
+func TestCreatePod(t *testing.T) {
+	k, fake := newTestK8S(t, &Config{GlobalEnv: map[string]string{"HTTP_PROXY": "proxy"}})
+
+	rec := serve(t, k.postPods, http.MethodPost, echo.MIMEApplicationJSON, testPod("exec-1"), "default")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	waitFor(t, "the pod to run", func() bool { return k.podPhase("default", "exec-1") == v1.PodRunning })
+
+	tasks := fake.Tasks()
+	if len(tasks) != 1 {
+		t.Fatalf("expected 1 task, got %d", len(tasks))
+	}
+	task := tasks[0]
+	if task.Name != "exec-1" || task.Image != "apache/spark" {
+		t.Fatalf("unexpected task %s (%s)", task.Name, task.Image)
+	}
+	if task.Env["HTTP_PROXY"] != "proxy" {
+		t.Fatalf("global env not set in the task: %v", task.Env)
+	}
+	if task.Labels[labelRunId] != k.runId || task.Labels[labelPodName] != "exec-1" {
+		t.Fatalf("unexpected task labels: %v", task.Labels)
+	}
+
+	// a retried request does not create a second task
+	rec = serve(t, k.postPods, http.MethodPost, echo.MIMEApplicationJSON, testPod("exec-1"), "default")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if n := len(fake.Tasks()); n != 1 {
+		t.Fatalf("expected 1 task after the retry, got %d", n)
+	}
+
+	// a pod without containers is invalid
+	rec = serve(t, k.postPods, http.MethodPost, echo.MIMEApplicationJSON, v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "exec-2"}}, "default")
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d", rec.Code)
+	}
+}
+
+func TestPodEvents(t *testing.T) {
+	cases := []struct {
+		name     string
+		exitCode int
+		phase    v1.PodPhase
+	}{
+		{"succeeded", 0, v1.PodSucceeded},
+		{"failed", 1, v1.PodFailed},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			k, fake := newTestK8S(t, &Config{})
+
+			serve(t, k.postPods, http.MethodPost, echo.MIMEApplicationJSON, testPod("exec-1"), "default")
+			waitFor(t, "the pod to run", func() bool { return k.podPhase("default", "exec-1") == v1.PodRunning })
+
+			if err := fake.Exit("exec-1", c.exitCode); err != nil {
+				t.Fatal(err)
+			}
+			// the finished pods are removed once their event is emitted
+			waitFor(t, "the pod to finish", func() bool { return k.podPhase("default", "exec-1") == "" })
+
+			expected := []string{"ADDED Pending", "MODIFIED Running", "MODIFIED " + string(c.phase), "DELETED " + string(c.phase)}
+			if events := k.podEvents("exec-1"); strings.Join(events, ",") != strings.Join(expected, ",") {
+				t.Fatalf("expected events %v, got %v", expected, events)
+			}
+		})
+	}
+}
+
+func TestCreatePodFailure(t *testing.T) {
+	k, fake := newTestK8S(t, &Config{})
+	fake.CreateErr = errors.New("no capacity")
+
+	serve(t, k.postPods, http.MethodPost, echo.MIMEApplicationJSON, testPod("exec-1"), "default")
+	waitFor(t, "the pod to fail", func() bool { return k.podPhase("default", "exec-1") == "" })
+
+	expected := []string{"ADDED Pending", "MODIFIED Failed", "DELETED Failed"}
+	if events := k.podEvents("exec-1"); strings.Join(events, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected events %v, got %v", expected, events)
+	}
+}
+
+func TestGatherLogs(t *testing.T) {
+	k, fake := newTestK8S(t, &Config{})
+	fake.Logs["exec-1"] = "hello from exec-1"
+
+	for _, name := range []string{"exec-1", "exec-2"} {
+		serve(t, k.postPods, http.MethodPost, echo.MIMEApplicationJSON, testPod(name), "default")
+		waitFor(t, "the pod to run", func() bool { return k.podPhase("default", name) == v1.PodRunning })
+	}
+	if err := fake.Exit("exec-1", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.Exit("exec-2", 2); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the pods to finish", func() bool {
+		return k.podPhase("default", "exec-1") == "" && k.podPhase("default", "exec-2") == ""
+	})
+
+	summary, err := k.GatherLogs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.Tasks) != 2 {
+		t.Fatalf("expected 2 tasks in the summary, got %d", len(summary.Tasks))
+	}
+
+	byName := map[string]TaskSummary{}
+	for _, task := range summary.Tasks {
+		byName[task.Name] = task
+	}
+	if task := byName["exec-1"]; task.Status != TaskSucceeded || task.ExitCode == nil || *task.ExitCode != 0 {
+		t.Fatalf("unexpected summary of exec-1: %+v", task)
+	}
+	if task := byName["exec-2"]; task.Status != TaskFailed || task.ExitCode == nil || *task.ExitCode != 2 {
+		t.Fatalf("unexpected summary of exec-2: %+v", task)
+	}
+
+	data, err := os.ReadFile(filepath.Join(summary.LogDir, "exec-1.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello from exec-1" {
+		t.Fatalf("unexpected logs: %s", data)
+	}
+}
+
+func TestGatherLogsError(t *testing.T) {
+	k, fake := newTestK8S(t, &Config{})
+	fake.LogsErr = errors.New("logs not available")
+
+	serve(t, k.postPods, http.MethodPost, echo.MIMEApplicationJSON, testPod("exec-1"), "default")
+	waitFor(t, "the pod to run", func() bool { return k.podPhase("default", "exec-1") == v1.PodRunning })
+
+	// the summary is returned with the error
+	summary, err := k.GatherLogs()
+	if err == nil || !strings.Contains(err.Error(), "logs not available") {
+		t.Fatalf("expected the logs error, got %v", err)
+	}
+	if summary == nil || len(summary.Tasks) != 1 {
+		t.Fatalf("expected the summary of 1 task, got %+v", summary)
+	}
+	if _, err := os.Stat(filepath.Join(summary.LogDir, "exec-1.error")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNormalizeControlPlaneAddr(t *testing.T) {
+	cases := []struct {
+		addr     string
+		expected string
+		err      bool
+	}{
+		{addr: "example.com", expected: "example.com"},
+		{addr: " 10.0.0.1 ", expected: "10.0.0.1"},
+		{addr: "example.com:1323", expected: "example.com"},
+		{addr: "10.0.0.1:1323", expected: "10.0.0.1"},
+		{addr: "http://example.com:1323/path", expected: "example.com"},
+		{addr: "https://10.0.0.1", expected: "10.0.0.1"},
+		{addr: "[::1]", expected: "::1"},
+		{addr: "[::1]:1323", expected: "::1"},
+		{addr: "http://[fe80::1]:1323", expected: "fe80::1"},
+		{addr: "", err: true},
+		{addr: "example.com/path", err: true},
+		{addr: "-example.com", err: true},
+		{addr: "http://%zz", err: true},
+	}
+	for _, c := range cases {
+		host, err := normalizeControlPlaneAddr(c.addr)
+		if c.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", c.addr, host)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.addr, err)
+		} else if host != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.addr, c.expected, host)
+		}
+	}
+}
+
+func TestPatchPodApply(t *testing.T) {
+	k, fake := newTestK8S(t, &Config{})
+	applyPatch := "application/apply-patch+yaml"
+
+	// the applied pod is created if it does not exist
+	pod := testPod("exec-1")
+	pod.Annotations = map[string]string{"a": "1"}
+	rec := serve(t, k.patchPod, http.MethodPatch, applyPatch, pod, "default", "exec-1")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	waitFor(t, "the pod to run", func() bool { return k.podPhase("default", "exec-1") == v1.PodRunning })
+	if n := len(fake.Tasks()); n != 1 {
+		t.Fatalf("expected 1 task, got %d", n)
+	}
+
+	// the labels and annotations of an existing pod are replaced
+	patch := v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:      map[string]string{"spark-role": "executor", "b": "2"},
+			Annotations: map[string]string{"c": "3"},
+		},
+	}
+	rec = serve(t, k.patchPod, http.MethodPatch, applyPatch, patch, "default", "exec-1")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var patched v1.Pod
+	if err := json.Unmarshal(rec.Body.Bytes(), &patched); err != nil {
+		t.Fatal(err)
+	}
+	if len(patched.Labels) != 2 || patched.Labels["b"] != "2" {
+		t.Fatalf("unexpected labels: %v", patched.Labels)
+	}
+	if len(patched.Annotations) != 1 || patched.Annotations["c"] != "3" {
+		t.Fatalf("unexpected annotations: %v", patched.Annotations)
+	}
+	if patched.Status.Phase != v1.PodRunning {
+		t.Fatalf("expected the pod to keep running, got %s", patched.Status.Phase)
+	}
+	if n := len(fake.Tasks()); n != 1 {
+		t.Fatalf("expected no new task, got %d", n)
+	}
+	if events := k.podEvents("exec-1"); events[len(events)-1] != "MODIFIED Running" {
+		t.Fatalf("expected a MODIFIED event, got %v", events)
+	}
+
+	// the name of the object must match the one on the URL
+	rec = serve(t, k.patchPod, http.MethodPatch, applyPatch, testPod("exec-2"), "default", "exec-1")
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+}
+
+func TestPatchPodUnsupportedMediaType(t *testing.T) {
+	k, fake := newTestK8S(t, &Config{})
+
+	for _, contentType := range []string{echo.MIMEApplicationJSON, "application/json-patch+json", ""} {
+		rec := serve(t, k.patchPod, http.MethodPatch, contentType, testPod("exec-1"), "default", "exec-1")
+		if rec.Code != http.StatusUnsupportedMediaType {
+			t.Fatalf("%q: expected 415, got %d", contentType, rec.Code)
+		}
+	}
+	if n := len(fake.Tasks()); n != 0 {
+		t.Fatalf("expected no task, got %d", n)
+	}
+}
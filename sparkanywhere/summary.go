@@ -0,0 +1,151 @@
+package sparkanywhere
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// exitCodeGetter is implemented by the providers that report the exit code
+// of the tasks. ok is false if the task has not exited yet.
+type exitCodeGetter interface {
+	ExitCode(ctx context.Context, handle *taskHandle) (code int, ok bool, err error)
+}
+
+var errExitCodeNotSupported = errors.New("exit codes are not supported by the provider")
+
+// RunSummary describes the outcome of every task of the run
+type RunSummary struct {
+	RunId  string        `json:"runId"`
+	LogDir string        `json:"logDir"`
+	Tasks  []TaskSummary `json:"tasks"`
+}
+
+type TaskSummary struct {
+	Name      string     `json:"name"`
+	Provider  string     `json:"provider"`
+	Id        string     `json:"id"`
+	RequestId string     `json:"requestId,omitempty"`
+	Restarts  int        `json:"restarts,omitempty"`
+	Started   *time.Time `json:"started,omitempty"`
+	Stopped   *time.Time `json:"stopped,omitempty"`
+	Status    TaskPhase  `json:"status,omitempty"`
+	ExitCode  *int       `json:"exitCode,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	LogFiles  []string   `json:"logFiles,omitempty"`
+}
+
+func (r *RunSummary) String() string {
+	var str strings.Builder
+	fmt.Fprintf(&str, "run: %s, logs: %s\n", r.RunId, r.LogDir)
+
+	w := tabwriter.NewWriter(&str, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tPROVIDER\tID\tSTATUS\tEXIT CODE\tDURATION\tLOGS")
+	for _, task := range r.Tasks {
+		exitCode, duration := "-", "-"
+		if task.ExitCode != nil {
+			exitCode = fmt.Sprint(*task.ExitCode)
+		}
+		if task.Started != nil && task.Stopped != nil {
+			duration = task.Stopped.Sub(*task.Started).Round(time.Second).String()
+		}
+		status := string(task.Status)
+		if status == "" {
+			status = "unknown"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", task.Name, task.Provider, task.Id, status, exitCode, duration, strings.Join(task.LogFiles, ","))
+	}
+	w.Flush()
+	return str.String()
+}
+
+// finishHandle records when the task of the handle exited, its error and its
+// exit code, while the task is still in the provider. It returns for how long
+// the task ran.
+func (k *K8S) finishHandle(handle *taskHandle, err error) time.Duration {
+	var exitCode *int
+	if getter, ok := k.provider.(exitCodeGetter); ok {
+		if code, ok, err := getter.ExitCode(k.ctx, handle); err == nil && ok {
+			exitCode = &code
+		}
+	}
+
+	k.handlesLock.Lock()
+	defer k.handlesLock.Unlock()
+
+	handle.StoppedAt = time.Now()
+	handle.phase = TaskSucceeded
+	if err != nil {
+		handle.err = err.Error()
+		handle.phase = TaskFailed
+	}
+	handle.exitCode = exitCode
+	return handle.StoppedAt.Sub(handle.StartedAt)
+}
+
+// taskSummary returns the summary of the task of the handle. The status and
+// the exit code of the finished tasks are the ones recorded when they exited,
+// the ones of the tasks that still run are queried to the provider. On
+// failure they are left empty.
+func (k *K8S) taskSummary(ctx context.Context, handle *taskHandle, logFiles []string) TaskSummary {
+	k.handlesLock.Lock()
+	summary := TaskSummary{
+		Name:      handle.Name,
+		Provider:  handle.Provider,
+		Id:        handle.Id,
+		RequestId: handle.RequestId,
+		Restarts:  handle.Restarts,
+		Status:    handle.phase,
+		ExitCode:  handle.exitCode,
+		Error:     handle.err,
+		LogFiles:  logFiles,
+	}
+	if !handle.StartedAt.IsZero() {
+		started := handle.StartedAt
+		summary.Started = &started
+	}
+	if !handle.StoppedAt.IsZero() {
+		stopped := handle.StoppedAt
+		summary.Stopped = &stopped
+	}
+	k.handlesLock.Unlock()
+
+	if summary.Stopped != nil {
+		return summary
+	}
+	if status, err := k.provider.TaskStatus(ctx, handle); err == nil {
+		summary.Status = status
+	}
+	if getter, ok := k.provider.(exitCodeGetter); ok {
+		if code, ok, err := getter.ExitCode(ctx, handle); err == nil && ok {
+			summary.ExitCode = &code
+		}
+	}
+	return summary
+}
+
+// getTasks returns the summary of every task of the run so far
+func (k *K8S) getTasks(c echo.Context) error {
+	tasks := []TaskSummary{}
+	for _, handle := range k.getHandles() {
+		tasks = append(tasks, k.taskSummary(c.Request().Context(), handle, nil))
+	}
+	return c.JSON(http.StatusOK, tasks)
+}
+
+// writeSummary writes the summary as JSON to path
+func writeSummary(path string, summary *RunSummary) error {
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,188 @@
+package sparkanywhere
+
+import (
+	"context"
+	"io"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is a no-op until initTracing installs the global tracer provider
+var tracer = otel.Tracer("github.com/ferranbt/sparkanywhere")
+
+// initTracing installs a tracer provider that exports the spans with OTLP
+// over HTTP to the given endpoint. It returns the function that flushes
+// and stops the exporter.
+func initTracing(ctx context.Context, endpoint string, insecure bool) (func(context.Context) error, error) {
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(endpoint),
+	}
+	if insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "sparkanywhere"))),
+	)
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown, nil
+}
+
+// traceStatus records a status transition of a task on the span of the context
+func traceStatus(ctx context.Context, status string) {
+	trace.SpanFromContext(ctx).AddEvent("status", trace.WithAttributes(attribute.String("status", status)))
+}
+
+// setDeploySpan stores the span context of the deploy of the app, an invalid
+// span context removes it
+func (k *K8S) setDeploySpan(appName string, spanCtx trace.SpanContext) {
+	k.deploySpansLock.Lock()
+	defer k.deploySpansLock.Unlock()
+
+	if spanCtx.IsValid() {
+		k.deploySpans[appName] = spanCtx
+	} else {
+		delete(k.deploySpans, appName)
+	}
+}
+
+// deploySpan returns the span context of the deploy of the app, it is
+// invalid (and the spans are roots) if the app is not deployed by us
+func (k *K8S) deploySpan(appName string) trace.SpanContext {
+	k.deploySpansLock.Lock()
+	defer k.deploySpansLock.Unlock()
+
+	return k.deploySpans[appName]
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracedProvider wraps a provider and creates a span for each call
+type tracedProvider struct {
+	provider
+}
+
+func (t *tracedProvider) CreateTask(ctx context.Context, task *Task) (handle *taskHandle, err error) {
+	ctx, span := tracer.Start(ctx, "CreateTask", trace.WithAttributes(attribute.String("task.name", task.Name)))
+	defer func() { endSpan(span, err) }()
+
+	handle, err = t.provider.CreateTask(ctx, task)
+	if err == nil {
+		span.SetAttributes(attribute.String("task.id", handle.Id))
+	}
+	return
+}
+
+func (t *tracedProvider) WaitForTask(ctx context.Context, handle *taskHandle) (err error) {
+	ctx, span := tracer.Start(ctx, "WaitForTask", trace.WithAttributes(attribute.String("task.name", handle.Name), attribute.String("task.id", handle.Id)))
+	defer func() { endSpan(span, err) }()
+
+	return t.provider.WaitForTask(ctx, handle)
+}
+
+func (t *tracedProvider) GetLogs(ctx context.Context, handle *taskHandle) (logs string, err error) {
+	ctx, span := tracer.Start(ctx, "GetLogs", trace.WithAttributes(attribute.String("task.name", handle.Name), attribute.String("task.id", handle.Id)))
+	defer func() { endSpan(span, err) }()
+
+	return t.provider.GetLogs(ctx, handle)
+}
+
+func (t *tracedProvider) StopTask(ctx context.Context, handle *taskHandle) (err error) {
+	ctx, span := tracer.Start(ctx, "StopTask", trace.WithAttributes(attribute.String("task.name", handle.Name), attribute.String("task.id", handle.Id)))
+	defer func() { endSpan(span, err) }()
+
+	return t.provider.StopTask(ctx, handle)
+}
+
+func (t *tracedProvider) TaskStatus(ctx context.Context, handle *taskHandle) (phase TaskPhase, err error) {
+	ctx, span := tracer.Start(ctx, "TaskStatus", trace.WithAttributes(attribute.String("task.name", handle.Name), attribute.String("task.id", handle.Id)))
+	defer func() { endSpan(span, err) }()
+
+	return t.provider.TaskStatus(ctx, handle)
+}
+
+func (t *tracedProvider) RemoveTask(ctx context.Context, handle *taskHandle) (err error) {
+	remover, ok := t.provider.(taskRemover)
+	if !ok {
+		return nil
+	}
+
+	ctx, span := tracer.Start(ctx, "RemoveTask", trace.WithAttributes(attribute.String("task.name", handle.Name), attribute.String("task.id", handle.Id)))
+	defer func() { endSpan(span, err) }()
+
+	return remover.RemoveTask(ctx, handle)
+}
+
+func (t *tracedProvider) StreamLogs(ctx context.Context, handle *taskHandle, w io.Writer) (err error) {
+	streamer, ok := t.provider.(logStreamer)
+	if !ok {
+		return errStreamLogsNotSupported
+	}
+
+	ctx, span := tracer.Start(ctx, "StreamLogs", trace.WithAttributes(attribute.String("task.name", handle.Name), attribute.String("task.id", handle.Id)))
+	defer func() { endSpan(span, err) }()
+
+	return streamer.StreamLogs(ctx, handle, w)
+}
+
+func (t *tracedProvider) GetStdLogs(ctx context.Context, handle *taskHandle) (stdout string, stderr string, err error) {
+	getter, ok := t.provider.(stdLogsGetter)
+	if !ok {
+		return "", "", errStdLogsNotSupported
+	}
+
+	ctx, span := tracer.Start(ctx, "GetStdLogs", trace.WithAttributes(attribute.String("task.name", handle.Name), attribute.String("task.id", handle.Id)))
+	defer func() { endSpan(span, err) }()
+
+	return getter.GetStdLogs(ctx, handle)
+}
+
+func (t *tracedProvider) ListOrphanedTasks(ctx context.Context, currentRunId string) (handles []*taskHandle, err error) {
+	lister, ok := t.provider.(orphanLister)
+	if !ok {
+		return nil, nil
+	}
+
+	ctx, span := tracer.Start(ctx, "ListOrphanedTasks")
+	defer func() { endSpan(span, err) }()
+
+	return lister.ListOrphanedTasks(ctx, currentRunId)
+}
+
+// Ping is not traced since it is called by the health checks
+func (t *tracedProvider) Ping(ctx context.Context) error {
+	if p, ok := t.provider.(pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (t *tracedProvider) ExitCode(ctx context.Context, handle *taskHandle) (code int, ok bool, err error) {
+	getter, isGetter := t.provider.(exitCodeGetter)
+	if !isGetter {
+		return 0, false, errExitCodeNotSupported
+	}
+
+	ctx, span := tracer.Start(ctx, "ExitCode", trace.WithAttributes(attribute.String("task.name", handle.Name), attribute.String("task.id", handle.Id)))
+	defer func() { endSpan(span, err) }()
+
+	return getter.ExitCode(ctx, handle)
+}
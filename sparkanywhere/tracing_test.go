@@ -0,0 +1,63 @@
+package sparkanywhere
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestTraceDeploySpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() { tp.Shutdown(context.Background()) })
+
+	k, fake := newTestK8S(t, &Config{})
+	k.provider = &tracedProvider{provider: k.provider}
+
+	// the deploy of the job is running while spark-submit creates its pods
+	_, deploySpan := tracer.Start(context.Background(), "deploy")
+	k.setDeploySpan("job", deploySpan.SpanContext())
+
+	pod := testPod("exec-1")
+	pod.Labels["spark-app-name"] = "job"
+	serve(t, k.postPods, http.MethodPost, echo.MIMEApplicationJSON, pod, "default")
+	waitFor(t, "the pod to run", func() bool { return k.podPhase("default", "exec-1") == v1.PodRunning })
+
+	if err := fake.Exit("exec-1", 0); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the pod to finish", func() bool { return k.podPhase("default", "exec-1") == "" })
+
+	// the logs are gathered once the deploy finished
+	k.setDeploySpan("job", trace.SpanContext{})
+	deploySpan.End()
+
+	if _, err := k.GatherLogs(); err != nil {
+		t.Fatal(err)
+	}
+
+	traceId := deploySpan.SpanContext().TraceID()
+	found := map[string]bool{}
+	for _, span := range recorder.Ended() {
+		switch span.Name() {
+		case "createPod", "CreateTask", "GetLogs":
+			found[span.Name()] = true
+			if span.SpanContext().TraceID() != traceId {
+				t.Fatalf("span %s is not in the trace of the deploy", span.Name())
+			}
+		}
+	}
+	for _, name := range []string{"createPod", "CreateTask", "GetLogs"} {
+		if !found[name] {
+			t.Fatalf("span %s not recorded", name)
+		}
+	}
+}
@@ -37,7 +37,8 @@ module "ecs_cluster" {
   }
 
   fargate_capacity_providers = {
-    FARGATE = {}
+    FARGATE      = {}
+    FARGATE_SPOT = {}
   }
 
   tags = local.tags